@@ -0,0 +1,281 @@
+// Package acme obtains and renews the wildcard TLS certificate for the
+// tunnel proxy domain via ACME DNS-01, persisting state in Postgres so it
+// survives restarts and is shared across pgrokd replicas.
+package acme
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"sync/atomic"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/go-acme/lego/v4/certificate"
+	"github.com/go-acme/lego/v4/challenge/dns01"
+	"github.com/go-acme/lego/v4/lego"
+	"github.com/go-acme/lego/v4/registration"
+	"github.com/pkg/errors"
+
+	"github.com/pgrok/pgrok/internal/conf"
+	"github.com/pgrok/pgrok/internal/database"
+)
+
+// userAgent identifies pgrokd to the ACME server and to DNS provider APIs.
+const userAgent = "pgrokd-acme/1.0 (+https://github.com/pgrok/pgrok)"
+
+// leaderLockKey is the Postgres advisory lock key pgrokd replicas contend for
+// before talking to the ACME server, so they don't race Let's Encrypt's rate
+// limits against each other.
+const leaderLockKey = 72109
+
+// renewBefore is how far ahead of expiry a certificate is renewed.
+const renewBefore = 30 * 24 * time.Hour
+
+// pollInterval is how often a replica re-checks whether the certificate
+// needs renewal.
+const pollInterval = 12 * time.Hour
+
+// acmeUser adapts a persisted ACME account to lego's registration.User.
+type acmeUser struct {
+	email        string
+	key          crypto.PrivateKey
+	registration *registration.Resource
+}
+
+func (u *acmeUser) GetEmail() string                        { return u.email }
+func (u *acmeUser) GetRegistration() *registration.Resource { return u.registration }
+func (u *acmeUser) GetPrivateKey() crypto.PrivateKey        { return u.key }
+
+// Manager obtains and renews the wildcard certificate for a domain and
+// serves it to the proxy's TLS listener.
+type Manager struct {
+	config *conf.ACME
+	db     *database.DB
+	domain string // base domain; the certificate covers it and "*."+domain
+
+	cert atomic.Pointer[tls.Certificate]
+}
+
+// NewManager creates a Manager for the given base domain. Call Start to load
+// or obtain the initial certificate and begin the renewal loop.
+func NewManager(config *conf.ACME, db *database.DB, domain string) *Manager {
+	return &Manager{config: config, db: db, domain: domain}
+}
+
+// GetCertificate implements tls.Config.GetCertificate, always serving the
+// most recently (re)loaded certificate.
+func (m *Manager) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert := m.cert.Load()
+	if cert == nil {
+		return nil, errors.New("acme: no certificate available yet")
+	}
+	return cert, nil
+}
+
+// ExpiresAt returns the NotAfter of the currently loaded certificate, used to
+// surface certificate health via /-/healthcheck.
+func (m *Manager) ExpiresAt() (time.Time, bool) {
+	cert := m.cert.Load()
+	if cert == nil || len(cert.Certificate) == 0 {
+		return time.Time{}, false
+	}
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return time.Time{}, false
+	}
+	return parsed.NotAfter, true
+}
+
+// Start loads the persisted certificate (obtaining one if needed) and begins
+// a background loop that keeps it renewed.
+func (m *Manager) Start(ctx context.Context) error {
+	if err := m.refresh(ctx); err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(pollInterval):
+				if err := m.refresh(ctx); err != nil {
+					log.Error("Failed to refresh ACME certificate", "error", err)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// refresh loads the persisted certificate if it's not close to expiry,
+// otherwise acquires the leader lock and requests a new one.
+func (m *Manager) refresh(ctx context.Context) error {
+	existing, err := m.db.GetACMECertificateByDomain(ctx, m.domain)
+	haveExisting := err == nil
+	if haveExisting && time.Until(existing.NotAfter) > renewBefore {
+		return m.loadCertificate(existing.CertificatePEM, existing.PrivateKeyPEM)
+	}
+
+	acquired, release, err := m.db.TryAcquireLock(ctx, leaderLockKey)
+	if err != nil {
+		return errors.Wrap(err, "acquire leader lock")
+	}
+	if !acquired {
+		// Another replica is already renewing. Serve what we have, even if
+		// it's close to expiry, and check again next poll.
+		if haveExisting {
+			return m.loadCertificate(existing.CertificatePEM, existing.PrivateKeyPEM)
+		}
+		log.Info("Waiting for the leader replica to obtain the initial ACME certificate")
+		return nil
+	}
+	defer release()
+
+	// Re-check under the lock: another replica may have just renewed it.
+	existing, err = m.db.GetACMECertificateByDomain(ctx, m.domain)
+	if err == nil && time.Until(existing.NotAfter) > renewBefore {
+		return m.loadCertificate(existing.CertificatePEM, existing.PrivateKeyPEM)
+	}
+
+	certPEM, keyPEM, notAfter, err := m.obtain(ctx)
+	if err != nil {
+		return errors.Wrap(err, "obtain certificate from the ACME server")
+	}
+
+	_, err = m.db.UpsertACMECertificate(ctx, database.UpsertACMECertificateOptions{
+		Domain:         m.domain,
+		CertificatePEM: certPEM,
+		PrivateKeyPEM:  keyPEM,
+		NotAfter:       notAfter,
+	})
+	if err != nil {
+		return errors.Wrap(err, "persist issued certificate")
+	}
+	log.Info("Obtained ACME certificate", "domain", m.domain, "notAfter", notAfter)
+	return m.loadCertificate(certPEM, keyPEM)
+}
+
+func (m *Manager) loadCertificate(certPEM, keyPEM []byte) error {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return errors.Wrap(err, "parse X509 key pair")
+	}
+	m.cert.Store(&cert)
+	return nil
+}
+
+// obtain registers (or reuses) the ACME account and requests a certificate
+// covering the domain and its wildcard subdomain via DNS-01.
+func (m *Manager) obtain(ctx context.Context) (certPEM, keyPEM []byte, notAfter time.Time, err error) {
+	user, err := m.loadOrRegisterUser(ctx)
+	if err != nil {
+		return nil, nil, time.Time{}, errors.Wrap(err, "load or register ACME account")
+	}
+
+	legoConfig := lego.NewConfig(user)
+	legoConfig.UserAgent = userAgent
+	if m.config.Staging {
+		legoConfig.CADirURL = lego.LEDirectoryStaging
+	} else {
+		legoConfig.CADirURL = lego.LEDirectoryProduction
+	}
+
+	client, err := lego.NewClient(legoConfig)
+	if err != nil {
+		return nil, nil, time.Time{}, errors.Wrap(err, "create ACME client")
+	}
+
+	provider, err := newDNSProvider(m.config)
+	if err != nil {
+		return nil, nil, time.Time{}, errors.Wrap(err, "create DNS provider")
+	}
+	if err := client.Challenge.SetDNS01Provider(provider, dns01.CondOption(true, dns01.AddDNSTimeout(10*time.Minute))); err != nil {
+		return nil, nil, time.Time{}, errors.Wrap(err, "set DNS-01 provider")
+	}
+
+	if user.registration == nil {
+		reg, err := client.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: true})
+		if err != nil {
+			return nil, nil, time.Time{}, errors.Wrap(err, "register ACME account")
+		}
+		user.registration = reg
+
+		regJSON, err := json.Marshal(reg)
+		if err != nil {
+			return nil, nil, time.Time{}, errors.Wrap(err, "marshal registration")
+		}
+		if _, err := m.db.UpsertACMEAccount(ctx, database.UpsertACMEAccountOptions{
+			Email:            m.config.Email,
+			PrivateKeyPEM:    marshalECPrivateKey(user.key.(*ecdsa.PrivateKey)),
+			RegistrationJSON: regJSON,
+		}); err != nil {
+			return nil, nil, time.Time{}, errors.Wrap(err, "persist ACME account")
+		}
+	}
+
+	request := certificate.ObtainRequest{
+		Domains: []string{m.domain, "*." + m.domain},
+		Bundle:  true,
+	}
+	cert, err := client.Certificate.Obtain(request)
+	if err != nil {
+		return nil, nil, time.Time{}, errors.Wrap(err, "obtain certificate")
+	}
+
+	x509Cert, err := x509.ParseCertificate(mustDecodeFirstPEMBlock(cert.Certificate))
+	if err != nil {
+		return nil, nil, time.Time{}, errors.Wrap(err, "parse issued certificate")
+	}
+	return cert.Certificate, cert.PrivateKey, x509Cert.NotAfter, nil
+}
+
+func (m *Manager) loadOrRegisterUser(ctx context.Context) (*acmeUser, error) {
+	account, err := m.db.GetACMEAccount(ctx)
+	if err != nil {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, errors.Wrap(err, "generate account key")
+		}
+		return &acmeUser{email: m.config.Email, key: key}, nil
+	}
+
+	keyBlock, _ := pem.Decode(account.PrivateKeyPEM)
+	if keyBlock == nil {
+		return nil, errors.New("decode persisted account private key")
+	}
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse persisted account private key")
+	}
+
+	var reg registration.Resource
+	if err := json.Unmarshal(account.RegistrationJSON, &reg); err != nil {
+		return nil, errors.Wrap(err, "unmarshal persisted registration")
+	}
+	return &acmeUser{email: account.Email, key: key, registration: &reg}, nil
+}
+
+func marshalECPrivateKey(key *ecdsa.PrivateKey) []byte {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		// The key was just generated by crypto/ecdsa, so this cannot fail.
+		panic(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+func mustDecodeFirstPEMBlock(p []byte) []byte {
+	block, _ := pem.Decode(p)
+	if block == nil {
+		panic("acme: expected at least one PEM block in issued certificate")
+	}
+	return block.Bytes
+}
@@ -0,0 +1,48 @@
+package acme
+
+import (
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/go-acme/lego/v4/providers/dns/cloudflare"
+	"github.com/go-acme/lego/v4/providers/dns/digitalocean"
+	"github.com/go-acme/lego/v4/providers/dns/route53"
+	"github.com/pkg/errors"
+
+	"github.com/pgrok/pgrok/internal/conf"
+)
+
+// newDNSProvider builds the lego DNS-01 challenge.Provider selected by
+// config.DNSProvider.
+func newDNSProvider(config *conf.ACME) (challenge.Provider, error) {
+	switch config.DNSProvider {
+	case "cloudflare":
+		if config.Cloudflare == nil {
+			return nil, errors.New("acme.cloudflare is not configured")
+		}
+		providerConfig := cloudflare.NewDefaultConfig()
+		providerConfig.AuthToken = config.Cloudflare.APIToken
+		providerConfig.UserAgent = userAgent
+		return cloudflare.NewDNSProviderConfig(providerConfig)
+
+	case "route53":
+		if config.Route53 == nil {
+			return nil, errors.New("acme.route53 is not configured")
+		}
+		providerConfig := route53.NewDefaultConfig()
+		providerConfig.AccessKeyID = config.Route53.AccessKeyID
+		providerConfig.SecretAccessKey = config.Route53.SecretAccessKey
+		providerConfig.Region = config.Route53.Region
+		providerConfig.HostedZoneID = config.Route53.HostedZoneID
+		return route53.NewDNSProviderConfig(providerConfig)
+
+	case "digitalocean":
+		if config.DigitalOcean == nil {
+			return nil, errors.New("acme.digitalocean is not configured")
+		}
+		providerConfig := digitalocean.NewDefaultConfig()
+		providerConfig.AuthToken = config.DigitalOcean.APIToken
+		return digitalocean.NewDNSProviderConfig(providerConfig)
+
+	default:
+		return nil, errors.Errorf("unsupported DNS provider %q", config.DNSProvider)
+	}
+}
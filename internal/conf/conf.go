@@ -0,0 +1,155 @@
+// Package conf defines and loads the configuration for pgrokd.
+package conf
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// Config represents the configuration of pgrokd.
+type Config struct {
+	// ExternalURL is the externally accessible base URL of pgrokd, e.g.
+	// "https://pgrokd.example.com".
+	ExternalURL string `yaml:"external_url"`
+
+	Database Database `yaml:"database"`
+	Web      Web      `yaml:"web"`
+	Proxy    Proxy    `yaml:"proxy"`
+	SSH      SSH      `yaml:"ssh"`
+	ACME     *ACME    `yaml:"acme,omitempty"`
+
+	// IdentityProviders are the OIDC identity providers this pgrokd instance
+	// federates with, e.g. to support both a corporate IdP and personal
+	// Google accounts at once. Each must have a unique, stable ID.
+	IdentityProviders []*IdentityProvider `yaml:"identity_providers,omitempty"`
+}
+
+// IdentityProviderByID returns the identity provider with the given ID, or
+// nil if none matches.
+func (c *Config) IdentityProviderByID(id string) *IdentityProvider {
+	for _, idp := range c.IdentityProviders {
+		if idp.ID == id {
+			return idp
+		}
+	}
+	return nil
+}
+
+// Database contains the configuration for the Postgres database.
+type Database struct {
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	Database string `yaml:"database"`
+}
+
+// Web contains the configuration for the web server.
+type Web struct {
+	Port int `yaml:"port"`
+}
+
+// Proxy contains the configuration for the tunnel proxy.
+type Proxy struct {
+	Scheme string `yaml:"scheme"`
+	Domain string `yaml:"domain"`
+
+	// Port is the port the tunnel-facing proxy listens on, separate from
+	// Web.Port. Leave unset (0) to disable the proxy listener, e.g. in a
+	// setup that terminates it elsewhere.
+	Port int `yaml:"port,omitempty"`
+}
+
+// SSH contains the configuration for the tunnel-facing SSH server that
+// authenticates clients and carries their tunnel traffic.
+type SSH struct {
+	// Port is the port the SSH server listens on. Leave unset (0) to
+	// disable it, e.g. in a setup that runs it as a separate process.
+	Port int `yaml:"port,omitempty"`
+}
+
+// FieldMapping maps OIDC claim names to the fields pgrokd cares about.
+type FieldMapping struct {
+	Identifier  string `yaml:"identifier"`
+	DisplayName string `yaml:"display_name,omitempty"`
+	Email       string `yaml:"email,omitempty"`
+}
+
+// IdentityProvider contains the configuration for an OIDC identity provider.
+type IdentityProvider struct {
+	// ID is a short, stable slug (e.g. "google", "corp-okta") used in OIDC
+	// routes and to key the provider against stored principals. Changing it
+	// orphans existing principals federated from this provider.
+	ID             string       `yaml:"id"`
+	DisplayName    string       `yaml:"display_name"`
+	Issuer         string       `yaml:"issuer"`
+	ClientID       string       `yaml:"client_id"`
+	ClientSecret   string       `yaml:"client_secret"`
+	RequiredDomain string       `yaml:"required_domain,omitempty"`
+	FieldMapping   FieldMapping `yaml:"field_mapping"`
+
+	// PostLogoutRedirectURIs are the URIs this pgrokd instance is allowed to
+	// ask the IdP to redirect back to once RP-initiated logout completes.
+	// They must be registered with the IdP ahead of time.
+	PostLogoutRedirectURIs []string `yaml:"post_logout_redirect_uris,omitempty"`
+
+	// EndSessionEndpoint is the IdP's RP-Initiated Logout 1.0 endpoint, as
+	// discovered from the provider's metadata. It is cached here after the
+	// first discovery so callers don't need to re-discover it. Empty means
+	// the IdP does not advertise one, in which case sign-out only clears the
+	// local session.
+	EndSessionEndpoint string `yaml:"-"`
+}
+
+// ACME contains the configuration for obtaining the tunnel proxy's wildcard
+// TLS certificate via Let's Encrypt using a DNS-01 challenge.
+type ACME struct {
+	// Email is the contact address given to the CA at registration.
+	Email string `yaml:"email"`
+	// Staging points at the CA's staging directory instead of production,
+	// useful for dry-running the setup without hitting real rate limits.
+	Staging bool `yaml:"staging,omitempty"`
+
+	// DNSProvider selects which pluggable DNS-01 provider to use: one of
+	// "cloudflare", "route53", or "digitalocean".
+	DNSProvider  string           `yaml:"dns_provider"`
+	Cloudflare   *CloudflareDNS   `yaml:"cloudflare,omitempty"`
+	Route53      *Route53DNS      `yaml:"route53,omitempty"`
+	DigitalOcean *DigitalOceanDNS `yaml:"digitalocean,omitempty"`
+}
+
+// CloudflareDNS contains the credentials for the Cloudflare DNS-01 provider.
+type CloudflareDNS struct {
+	APIToken string `yaml:"api_token"`
+}
+
+// Route53DNS contains the credentials for the AWS Route53 DNS-01 provider.
+type Route53DNS struct {
+	AccessKeyID     string `yaml:"access_key_id"`
+	SecretAccessKey string `yaml:"secret_access_key"`
+	Region          string `yaml:"region,omitempty"`
+	HostedZoneID    string `yaml:"hosted_zone_id,omitempty"`
+}
+
+// DigitalOceanDNS contains the credentials for the DigitalOcean DNS-01
+// provider.
+type DigitalOceanDNS struct {
+	APIToken string `yaml:"api_token"`
+}
+
+// Load reads and parses the configuration from the given path.
+func Load(configPath string) (*Config, error) {
+	p, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "read file")
+	}
+
+	var config Config
+	err = yaml.Unmarshal(p, &config)
+	if err != nil {
+		return nil, errors.Wrap(err, "unmarshal")
+	}
+	return &config, nil
+}
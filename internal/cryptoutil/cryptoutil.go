@@ -0,0 +1,26 @@
+// Package cryptoutil provides helpers around common cryptographic operations.
+package cryptoutil
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+)
+
+// SHA1 returns the hex-encoded SHA-1 checksum of the given string.
+func SHA1(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// SHA256 returns the raw SHA-256 checksum of the given string.
+func SHA256(s string) []byte {
+	sum := sha256.Sum256([]byte(s))
+	return sum[:]
+}
+
+// Base64URLEncode returns the base64url (no padding) encoding of the given bytes.
+func Base64URLEncode(p []byte) string {
+	return base64.RawURLEncoding.EncodeToString(p)
+}
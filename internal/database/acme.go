@@ -0,0 +1,143 @@
+package database
+
+import (
+	"context"
+	"time"
+)
+
+// ACMEAccount represents the ACME account pgrokd registered with the CA,
+// persisted so every replica reuses the same account instead of registering
+// a new one on every restart.
+type ACMEAccount struct {
+	ID int64 `gorm:"primaryKey"`
+	// Email is the contact address given to the CA at registration.
+	Email string `gorm:"not null"`
+	// PrivateKeyPEM is the PEM-encoded account private key.
+	PrivateKeyPEM []byte `gorm:"not null"`
+	// RegistrationJSON is the CA's registration resource, JSON-encoded.
+	RegistrationJSON []byte    `gorm:"not null"`
+	CreatedAt        time.Time `gorm:"not null"`
+	UpdatedAt        time.Time `gorm:"not null"`
+}
+
+func (*ACMEAccount) TableName() string {
+	return "acme_accounts"
+}
+
+// ACMECertificate represents an issued certificate persisted so every pgrokd
+// replica can serve it without requesting its own from the CA.
+type ACMECertificate struct {
+	ID int64 `gorm:"primaryKey"`
+	// Domain is the primary domain the certificate was requested for, e.g.
+	// "example.com" for a certificate covering it and "*.example.com".
+	Domain         string    `gorm:"unique;not null"`
+	CertificatePEM []byte    `gorm:"not null"`
+	PrivateKeyPEM  []byte    `gorm:"not null"`
+	NotAfter       time.Time `gorm:"not null"`
+	CreatedAt      time.Time `gorm:"not null"`
+	UpdatedAt      time.Time `gorm:"not null"`
+}
+
+func (*ACMECertificate) TableName() string {
+	return "acme_certificates"
+}
+
+// GetACMEAccount returns the single persisted ACME account, if any.
+func (db *DB) GetACMEAccount(ctx context.Context) (*ACMEAccount, error) {
+	var a ACMEAccount
+	return &a, db.WithContext(ctx).First(&a).Error
+}
+
+type UpsertACMEAccountOptions struct {
+	Email            string
+	PrivateKeyPEM    []byte
+	RegistrationJSON []byte
+}
+
+// UpsertACMEAccount creates the ACME account record if none exists yet, or
+// updates the registration of the existing one.
+func (db *DB) UpsertACMEAccount(ctx context.Context, opts UpsertACMEAccountOptions) (*ACMEAccount, error) {
+	existing, err := db.GetACMEAccount(ctx)
+	if err != nil {
+		a := &ACMEAccount{
+			Email:            opts.Email,
+			PrivateKeyPEM:    opts.PrivateKeyPEM,
+			RegistrationJSON: opts.RegistrationJSON,
+		}
+		return a, db.WithContext(ctx).Create(a).Error
+	}
+
+	existing.RegistrationJSON = opts.RegistrationJSON
+	return existing, db.WithContext(ctx).Save(existing).Error
+}
+
+// GetACMECertificateByDomain returns the persisted certificate for the given
+// domain.
+func (db *DB) GetACMECertificateByDomain(ctx context.Context, domain string) (*ACMECertificate, error) {
+	var c ACMECertificate
+	return &c, db.WithContext(ctx).Where("domain = ?", domain).First(&c).Error
+}
+
+type UpsertACMECertificateOptions struct {
+	Domain         string
+	CertificatePEM []byte
+	PrivateKeyPEM  []byte
+	NotAfter       time.Time
+}
+
+// UpsertACMECertificate creates or replaces the persisted certificate for a
+// domain.
+func (db *DB) UpsertACMECertificate(ctx context.Context, opts UpsertACMECertificateOptions) (*ACMECertificate, error) {
+	c := &ACMECertificate{
+		Domain:         opts.Domain,
+		CertificatePEM: opts.CertificatePEM,
+		PrivateKeyPEM:  opts.PrivateKeyPEM,
+		NotAfter:       opts.NotAfter,
+	}
+	return c, db.WithContext(ctx).
+		Where("domain = ?", opts.Domain).
+		Assign(c).
+		FirstOrCreate(c).Error
+}
+
+// TryAcquireLock attempts to take a Postgres advisory lock identified by key,
+// used to elect a single leader replica for operations that must not run
+// concurrently across pgrokd instances (e.g. talking to the ACME server).
+// The returned release function must be called to give up the lock; it is
+// a no-op if acquired is false.
+//
+// pg_try_advisory_lock is session-level: it's only held on the connection
+// that took it, and pg_advisory_unlock on any other connection is a silent
+// no-op. So this pins a single *sql.Conn out of the pool for the lock's
+// whole lifetime instead of going through GORM's normal per-call pooling,
+// which would acquire and release on two different connections and never
+// actually free the lock.
+func (db *DB) TryAcquireLock(ctx context.Context, key int64) (acquired bool, release func(), err error) {
+	sqlDB, err := db.DB.DB()
+	if err != nil {
+		return false, func() {}, err
+	}
+
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return false, func() {}, err
+	}
+
+	var ok bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", key).Scan(&ok); err != nil {
+		_ = conn.Close()
+		return false, func() {}, err
+	}
+	if !ok {
+		_ = conn.Close()
+		return false, func() {}, nil
+	}
+
+	return true, func() {
+		// Best effort: closing conn returns it to the pool without ending
+		// its session, so if the unlock call itself fails the lock stays
+		// held until that pooled connection is eventually closed.
+		_, _ = conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", key)
+		_ = conn.Close()
+	}, nil
+}
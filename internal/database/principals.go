@@ -6,10 +6,16 @@ import (
 )
 
 // Principal represents a user.
+//
+// A principal is uniquely identified by the combination of Provider and
+// Identifier, not Identifier alone, so the same identifier (e.g. an email
+// address) can be federated in from more than one identity provider without
+// colliding.
 type Principal struct {
-	ID          int64  `gorm:"primaryKey"`
-	Identifier  string `gorm:"unique;not null"`
-	DisplayName string `gorm:"not null"`
+	ID          int64     `gorm:"primaryKey"`
+	Provider    string    `gorm:"uniqueIndex:idx_principals_provider_identifier;not null"`
+	Identifier  string    `gorm:"uniqueIndex:idx_principals_provider_identifier;not null"`
+	DisplayName string    `gorm:"not null"`
 	CreatedAt   time.Time `gorm:"not null"`
 	UpdatedAt   time.Time `gorm:"not null"`
 }
@@ -19,6 +25,7 @@ func (*Principal) TableName() string {
 }
 
 type UpsertPrincipalOptions struct {
+	Provider    string
 	Identifier  string
 	DisplayName string
 }
@@ -26,10 +33,13 @@ type UpsertPrincipalOptions struct {
 // UpsertPrincipal upserts a principle with given options.
 func (db *DB) UpsertPrincipal(ctx context.Context, opts UpsertPrincipalOptions) (*Principal, error) {
 	p := &Principal{
+		Provider:    opts.Provider,
 		Identifier:  opts.Identifier,
 		DisplayName: opts.DisplayName,
 	}
-	return p, db.WithContext(ctx).Where("identifier = ?", opts.Identifier).FirstOrCreate(p).Error
+	return p, db.WithContext(ctx).
+		Where("provider = ? AND identifier = ?", opts.Provider, opts.Identifier).
+		FirstOrCreate(p).Error
 }
 
 // GetPrincipalByID returns a principle with given id.
@@ -37,3 +47,24 @@ func (db *DB) GetPrincipalByID(ctx context.Context, id int64) (*Principal, error
 	var p Principal
 	return &p, db.WithContext(ctx).Where("id = ?", id).First(&p).Error
 }
+
+// legacyIdentifierIndex is the single-column unique index Identifier used to
+// have before it became part of the composite idx_principals_provider_identifier
+// index. GORM's AutoMigrate only adds indexes implied by current struct
+// tags, it never drops ones a tag change made obsolete, so the old index
+// has to be dropped explicitly or it keeps enforcing the one-provider-per-
+// identifier constraint this type's doc comment says no longer applies.
+const legacyIdentifierIndex = "idx_principles_identifier"
+
+// DropLegacyIdentifierIndex drops legacyIdentifierIndex if it still exists.
+// Must run once, after AutoMigrate has created the composite index and
+// before any principal is upserted with an identifier already used by a
+// different provider. Safe to call on every startup: dropping an
+// already-dropped index is a no-op.
+func (db *DB) DropLegacyIdentifierIndex(ctx context.Context) error {
+	migrator := db.WithContext(ctx).Migrator()
+	if !migrator.HasIndex(&Principal{}, legacyIdentifierIndex) {
+		return nil
+	}
+	return migrator.DropIndex(&Principal{}, legacyIdentifierIndex)
+}
@@ -0,0 +1,47 @@
+package database
+
+import (
+	"context"
+	"time"
+)
+
+// Secret is a named, server-generated byte string persisted so every pgrokd
+// replica (and every restart of a single instance) uses the same value,
+// e.g. policyAuthSecret in pgrokd/cli/web_server.go.
+type Secret struct {
+	ID        int64     `gorm:"primaryKey"`
+	Name      string    `gorm:"unique;not null"`
+	Value     []byte    `gorm:"not null"`
+	CreatedAt time.Time `gorm:"not null"`
+}
+
+func (*Secret) TableName() string {
+	return "secrets"
+}
+
+// GetOrCreateSecret returns the named secret's value, creating it with
+// generate if it doesn't exist yet. Concurrent callers racing to create the
+// same name are resolved by retrying the read after a unique-constraint
+// failure, so every replica converges on whichever value won.
+func (db *DB) GetOrCreateSecret(ctx context.Context, name string, generate func() ([]byte, error)) ([]byte, error) {
+	var s Secret
+	err := db.WithContext(ctx).Where("name = ?", name).First(&s).Error
+	if err == nil {
+		return s.Value, nil
+	}
+
+	value, err := generate()
+	if err != nil {
+		return nil, err
+	}
+
+	s = Secret{Name: name, Value: value}
+	if err := db.WithContext(ctx).Create(&s).Error; err != nil {
+		// Lost the race to another replica; read back whatever it created.
+		if err := db.WithContext(ctx).Where("name = ?", name).First(&s).Error; err != nil {
+			return nil, err
+		}
+		return s.Value, nil
+	}
+	return s.Value, nil
+}
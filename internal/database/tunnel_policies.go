@@ -0,0 +1,68 @@
+package database
+
+import (
+	"context"
+	"time"
+)
+
+// TunnelPolicy restricts who can reach a tunnel's subdomain, so a user
+// doesn't need to run a separate auth proxy in front of it.
+//
+// CIDR rules are evaluated first: the most specific (longest-prefix) match
+// wins, and a tie between an allow and a deny rule of the same prefix length
+// is resolved in favor of the deny. When RequireAuth is set, a request that
+// isn't denied by a CIDR rule must also complete the OIDC login flow, and
+// the resulting claims must satisfy at least one of AllowedEmails,
+// AllowedGroups, or AllowedDomains (an empty list imposes no restriction on
+// that claim).
+type TunnelPolicy struct {
+	ID             int64     `gorm:"primaryKey"`
+	TunnelID       int64     `gorm:"uniqueIndex;not null"`
+	AllowCIDRs     []string  `gorm:"serializer:json"`
+	DenyCIDRs      []string  `gorm:"serializer:json"`
+	RequireAuth    bool      `gorm:"not null;default:false"`
+	AllowedEmails  []string  `gorm:"serializer:json"`
+	AllowedGroups  []string  `gorm:"serializer:json"`
+	AllowedDomains []string  `gorm:"serializer:json"`
+	CreatedAt      time.Time `gorm:"not null"`
+	UpdatedAt      time.Time `gorm:"not null"`
+}
+
+func (*TunnelPolicy) TableName() string {
+	return "tunnel_policies"
+}
+
+// UpsertTunnelPolicyOptions contains options for upserting a tunnel policy.
+type UpsertTunnelPolicyOptions struct {
+	TunnelID       int64
+	AllowCIDRs     []string
+	DenyCIDRs      []string
+	RequireAuth    bool
+	AllowedEmails  []string
+	AllowedGroups  []string
+	AllowedDomains []string
+}
+
+// UpsertTunnelPolicy creates or replaces the policy for a tunnel.
+func (db *DB) UpsertTunnelPolicy(ctx context.Context, opts UpsertTunnelPolicyOptions) (*TunnelPolicy, error) {
+	p := &TunnelPolicy{
+		TunnelID:       opts.TunnelID,
+		AllowCIDRs:     opts.AllowCIDRs,
+		DenyCIDRs:      opts.DenyCIDRs,
+		RequireAuth:    opts.RequireAuth,
+		AllowedEmails:  opts.AllowedEmails,
+		AllowedGroups:  opts.AllowedGroups,
+		AllowedDomains: opts.AllowedDomains,
+	}
+	return p, db.WithContext(ctx).
+		Where("tunnel_id = ?", opts.TunnelID).
+		Assign(p).
+		FirstOrCreate(p).Error
+}
+
+// GetTunnelPolicyByTunnelID returns the policy for a tunnel, if one has been
+// set.
+func (db *DB) GetTunnelPolicyByTunnelID(ctx context.Context, tunnelID int64) (*TunnelPolicy, error) {
+	var p TunnelPolicy
+	return &p, db.WithContext(ctx).Where("tunnel_id = ?", tunnelID).First(&p).Error
+}
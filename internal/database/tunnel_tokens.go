@@ -0,0 +1,78 @@
+package database
+
+import (
+	"context"
+	"time"
+)
+
+// TunnelToken is a per-device access token that authorizes SSH access to a
+// single tunnel, issued through the OAuth-style authorization flow rather
+// than being the long-lived, shared secret on Tunnel.Token.
+type TunnelToken struct {
+	ID         int64  `gorm:"primaryKey"`
+	TunnelID   int64  `gorm:"index;not null"`
+	TokenHash  string `gorm:"unique;not null"`
+	Label      string
+	CreatedAt  time.Time `gorm:"not null"`
+	LastUsedAt *time.Time
+	RevokedAt  *time.Time
+}
+
+func (*TunnelToken) TableName() string {
+	return "tunnel_tokens"
+}
+
+// CreateTunnelTokenOptions contains options for creating a tunnel token.
+type CreateTunnelTokenOptions struct {
+	TunnelID  int64
+	TokenHash string
+	Label     string
+}
+
+// CreateTunnelToken creates a new tunnel token with given options. The caller
+// is expected to have already hashed the opaque access token handed to the
+// client; only the hash is ever persisted.
+func (db *DB) CreateTunnelToken(ctx context.Context, opts CreateTunnelTokenOptions) (*TunnelToken, error) {
+	t := &TunnelToken{
+		TunnelID:  opts.TunnelID,
+		TokenHash: opts.TokenHash,
+		Label:     opts.Label,
+	}
+	return t, db.WithContext(ctx).Create(t).Error
+}
+
+// GetTunnelTokenByHash returns the non-revoked tunnel token with the given
+// hash.
+func (db *DB) GetTunnelTokenByHash(ctx context.Context, tokenHash string) (*TunnelToken, error) {
+	var t TunnelToken
+	return &t, db.WithContext(ctx).
+		Where("token_hash = ? AND revoked_at IS NULL", tokenHash).
+		First(&t).Error
+}
+
+// GetTunnelTokensByTunnelID returns all tokens issued for the given tunnel,
+// including revoked ones, most recently created first.
+func (db *DB) GetTunnelTokensByTunnelID(ctx context.Context, tunnelID int64) ([]*TunnelToken, error) {
+	var tokens []*TunnelToken
+	return tokens, db.WithContext(ctx).
+		Where("tunnel_id = ?", tunnelID).
+		Order("created_at DESC").
+		Find(&tokens).Error
+}
+
+// TouchTunnelTokenLastUsed records that the token was just used to
+// authenticate.
+func (db *DB) TouchTunnelTokenLastUsed(ctx context.Context, id int64) error {
+	return db.WithContext(ctx).
+		Model(&TunnelToken{}).
+		Where("id = ?", id).
+		Update("last_used_at", time.Now()).Error
+}
+
+// DeleteTunnelTokenByID revokes the token by deleting it, scoped to the
+// given tunnel so a caller can't delete another tunnel's token.
+func (db *DB) DeleteTunnelTokenByID(ctx context.Context, id, tunnelID int64) error {
+	return db.WithContext(ctx).
+		Where("id = ? AND tunnel_id = ?", id, tunnelID).
+		Delete(&TunnelToken{}).Error
+}
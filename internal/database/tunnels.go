@@ -49,12 +49,54 @@ func (db *DB) GetTunnelByID(ctx context.Context, id int64) (*Tunnel, error) {
 	return &t, db.WithContext(ctx).Where("id = ?", id).First(&t).Error
 }
 
+// GetTunnelBySubdomain returns a tunnel with given subdomain, as resolved
+// from the Host header of an inbound proxy request.
+func (db *DB) GetTunnelBySubdomain(ctx context.Context, subdomain string) (*Tunnel, error) {
+	var t Tunnel
+	return &t, db.WithContext(ctx).Where("subdomain = ?", subdomain).First(&t).Error
+}
+
 // GetTunnelByToken returns a tunnel with given token.
+//
+// Deprecated: the legacy Tunnel.Token is a long-lived, non-revocable secret
+// shared by every device. New clients should authenticate with a
+// TunnelToken issued through the OAuth authorization-code flow instead; see
+// GetTunnelByAuthToken. This is kept working during the deprecation window.
 func (db *DB) GetTunnelByToken(ctx context.Context, token string) (*Tunnel, error) {
 	var t Tunnel
 	return &t, db.WithContext(ctx).Where("token = ?", token).First(&t).Error
 }
 
+// GetTunnelByAuthToken resolves the SSH auth secret presented by a client to
+// its tunnel. tokenHash is the hash of a per-device TunnelToken; legacyToken
+// is the same raw secret checked against the deprecated Tunnel.Token column
+// so existing devices keep working until they're migrated. Callers should
+// prefer the TunnelToken result (non-nil) when present, and call
+// TouchTunnelTokenLastUsed for it.
+func (db *DB) GetTunnelByAuthToken(ctx context.Context, tokenHash, legacyToken string) (*Tunnel, *TunnelToken, error) {
+	tunnelToken, err := db.GetTunnelTokenByHash(ctx, tokenHash)
+	if err == nil {
+		tunnel, err := db.GetTunnelByID(ctx, tunnelToken.TunnelID)
+		if err != nil {
+			return nil, nil, err
+		}
+		return tunnel, tunnelToken, nil
+	}
+
+	tunnel, err := db.GetTunnelByToken(ctx, legacyToken)
+	if err != nil {
+		return nil, nil, err
+	}
+	return tunnel, nil, nil
+}
+
+// GetTunnelByPrincipalIDAndName returns the tunnel with the given name,
+// scoped to the owning principal.
+func (db *DB) GetTunnelByPrincipalIDAndName(ctx context.Context, principalID int64, name string) (*Tunnel, error) {
+	var t Tunnel
+	return &t, db.WithContext(ctx).Where("principal_id = ? AND name = ?", principalID, name).First(&t).Error
+}
+
 // GetTunnelsByPrincipalID returns all tunnels belong to the given principal.
 func (db *DB) GetTunnelsByPrincipalID(ctx context.Context, principalID int64) ([]*Tunnel, error) {
 	var tunnels []*Tunnel
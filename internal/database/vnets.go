@@ -0,0 +1,166 @@
+package database
+
+import (
+	"context"
+	"time"
+)
+
+// VirtualNetwork groups tunnels owned by (or shared with) a principal so
+// they can route private traffic to each other without exposing anything on
+// the public proxy.
+type VirtualNetwork struct {
+	ID          int64  `gorm:"primaryKey"`
+	PrincipalID int64  `gorm:"index;not null"`
+	Name        string `gorm:"not null"`
+	Comment     string
+	IsDefault   bool      `gorm:"not null;default:false"`
+	CreatedAt   time.Time `gorm:"not null"`
+	UpdatedAt   time.Time `gorm:"not null"`
+}
+
+func (*VirtualNetwork) TableName() string {
+	return "virtual_networks"
+}
+
+// IPRoute directs traffic to a CIDR within a VirtualNetwork to a specific
+// tunnel.
+type IPRoute struct {
+	ID        int64  `gorm:"primaryKey"`
+	VNetID    int64  `gorm:"index;not null"`
+	Network   string `gorm:"not null"` // CIDR, e.g. "10.1.0.0/24"
+	TunnelID  int64  `gorm:"index;not null"`
+	Comment   string
+	CreatedAt time.Time `gorm:"not null"`
+	UpdatedAt time.Time `gorm:"not null"`
+}
+
+func (*IPRoute) TableName() string {
+	return "ip_routes"
+}
+
+// VNetMembership grants a tunnel membership in a VirtualNetwork, allowing it
+// to both receive routed traffic and dial other members.
+type VNetMembership struct {
+	VNetID   int64 `gorm:"primaryKey"`
+	TunnelID int64 `gorm:"primaryKey"`
+}
+
+func (*VNetMembership) TableName() string {
+	return "vnet_memberships"
+}
+
+// CreateVirtualNetworkOptions contains options for creating a virtual network.
+type CreateVirtualNetworkOptions struct {
+	PrincipalID int64
+	Name        string
+	Comment     string
+	IsDefault   bool
+}
+
+// CreateVirtualNetwork creates a new virtual network with given options.
+func (db *DB) CreateVirtualNetwork(ctx context.Context, opts CreateVirtualNetworkOptions) (*VirtualNetwork, error) {
+	v := &VirtualNetwork{
+		PrincipalID: opts.PrincipalID,
+		Name:        opts.Name,
+		Comment:     opts.Comment,
+		IsDefault:   opts.IsDefault,
+	}
+	return v, db.WithContext(ctx).Create(v).Error
+}
+
+// GetOrCreateDefaultVirtualNetwork returns the principal's default virtual
+// network, creating it on first use so the CLI doesn't need to know a vnet
+// ID just to add a route.
+func (db *DB) GetOrCreateDefaultVirtualNetwork(ctx context.Context, principalID int64) (*VirtualNetwork, error) {
+	v := &VirtualNetwork{
+		PrincipalID: principalID,
+		Name:        "default",
+		IsDefault:   true,
+	}
+	return v, db.WithContext(ctx).
+		Where("principal_id = ? AND is_default = ?", principalID, true).
+		FirstOrCreate(v).Error
+}
+
+// GetVirtualNetworkByID returns a virtual network with given id, scoped to
+// the owning principal.
+func (db *DB) GetVirtualNetworkByID(ctx context.Context, id, principalID int64) (*VirtualNetwork, error) {
+	var v VirtualNetwork
+	return &v, db.WithContext(ctx).
+		Where("id = ? AND principal_id = ?", id, principalID).
+		First(&v).Error
+}
+
+// GetVirtualNetworksByPrincipalID returns all virtual networks owned by the
+// given principal.
+func (db *DB) GetVirtualNetworksByPrincipalID(ctx context.Context, principalID int64) ([]*VirtualNetwork, error) {
+	var vnets []*VirtualNetwork
+	return vnets, db.WithContext(ctx).Where("principal_id = ?", principalID).Find(&vnets).Error
+}
+
+// DeleteVirtualNetworkByID deletes the virtual network by the given ID and
+// principal ID.
+func (db *DB) DeleteVirtualNetworkByID(ctx context.Context, id, principalID int64) error {
+	return db.WithContext(ctx).
+		Where("id = ? AND principal_id = ?", id, principalID).
+		Delete(&VirtualNetwork{}).Error
+}
+
+// CreateIPRouteOptions contains options for creating an IP route.
+type CreateIPRouteOptions struct {
+	VNetID   int64
+	Network  string
+	TunnelID int64
+	Comment  string
+}
+
+// CreateIPRoute creates a new IP route with given options.
+func (db *DB) CreateIPRoute(ctx context.Context, opts CreateIPRouteOptions) (*IPRoute, error) {
+	r := &IPRoute{
+		VNetID:   opts.VNetID,
+		Network:  opts.Network,
+		TunnelID: opts.TunnelID,
+		Comment:  opts.Comment,
+	}
+	return r, db.WithContext(ctx).Create(r).Error
+}
+
+// GetIPRoutesByVNetID returns all IP routes within the given virtual
+// network.
+func (db *DB) GetIPRoutesByVNetID(ctx context.Context, vnetID int64) ([]*IPRoute, error) {
+	var routes []*IPRoute
+	return routes, db.WithContext(ctx).Where("vnet_id = ?", vnetID).Find(&routes).Error
+}
+
+// DeleteIPRouteByID deletes the IP route by the given ID, scoped to the
+// given virtual network.
+func (db *DB) DeleteIPRouteByID(ctx context.Context, id, vnetID int64) error {
+	return db.WithContext(ctx).
+		Where("id = ? AND vnet_id = ?", id, vnetID).
+		Delete(&IPRoute{}).Error
+}
+
+// AddVNetMember adds a tunnel as a member of a virtual network, so it can
+// both receive routed traffic and dial other members.
+func (db *DB) AddVNetMember(ctx context.Context, vnetID, tunnelID int64) error {
+	return db.WithContext(ctx).
+		Where("vnet_id = ? AND tunnel_id = ?", vnetID, tunnelID).
+		FirstOrCreate(&VNetMembership{VNetID: vnetID, TunnelID: tunnelID}).Error
+}
+
+// RemoveVNetMember removes a tunnel's membership in a virtual network.
+func (db *DB) RemoveVNetMember(ctx context.Context, vnetID, tunnelID int64) error {
+	return db.WithContext(ctx).
+		Where("vnet_id = ? AND tunnel_id = ?", vnetID, tunnelID).
+		Delete(&VNetMembership{}).Error
+}
+
+// GetVNetMembersByVNetID returns the tunnel IDs that are members of the
+// given virtual network.
+func (db *DB) GetVNetMembersByVNetID(ctx context.Context, vnetID int64) ([]int64, error) {
+	var tunnelIDs []int64
+	return tunnelIDs, db.WithContext(ctx).
+		Model(&VNetMembership{}).
+		Where("vnet_id = ?", vnetID).
+		Pluck("tunnel_id", &tunnelIDs).Error
+}
@@ -0,0 +1,84 @@
+package policy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// Claims is the subset of OIDC claims a RequireAuth policy checks,
+// captured once when the visitor completes the login and carried in the
+// signed subdomain cookie so later requests don't need to re-verify the ID
+// token. See idpUserInfo in pgrokd/cli/web_server.go for where these come
+// from.
+type Claims struct {
+	Email        string   `json:"email"`
+	Groups       []string `json:"groups,omitempty"`
+	HostedDomain string   `json:"hd,omitempty"`
+}
+
+type cookiePayload struct {
+	Subdomain string `json:"subdomain"`
+	Claims    Claims `json:"claims"`
+	ExpiresAt int64  `json:"expiresAt"`
+}
+
+// SignSubdomainCookie returns a signed, short-lived token proving claims
+// completed the OIDC login for subdomain. The token is scoped to a single
+// subdomain so it can't be replayed against a different tunnel's policy.
+func SignSubdomainCookie(secret []byte, subdomain string, claims Claims, ttl time.Duration) (string, error) {
+	raw, err := json.Marshal(cookiePayload{
+		Subdomain: subdomain,
+		Claims:    claims,
+		ExpiresAt: time.Now().Add(ttl).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(raw)
+	sig := signCookiePayload(secret, encoded)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// VerifySubdomainCookie checks that token was signed by secret for
+// subdomain and hasn't expired, returning the claims it was issued with.
+func VerifySubdomainCookie(secret []byte, subdomain, token string) (Claims, bool) {
+	encoded, encodedSig, found := strings.Cut(token, ".")
+	if !found {
+		return Claims{}, false
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(encodedSig)
+	if err != nil {
+		return Claims{}, false
+	}
+	if subtle.ConstantTimeCompare(sig, signCookiePayload(secret, encoded)) != 1 {
+		return Claims{}, false
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return Claims{}, false
+	}
+	var payload cookiePayload
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		return Claims{}, false
+	}
+	if payload.Subdomain != subdomain {
+		return Claims{}, false
+	}
+	if time.Now().Unix() > payload.ExpiresAt {
+		return Claims{}, false
+	}
+	return payload.Claims, true
+}
+
+func signCookiePayload(secret []byte, payload string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,235 @@
+// Package policy evaluates per-tunnel access policies: CIDR allow/deny
+// lists and, when required, OIDC claim checks. Compiled policies are cached
+// per tunnel and invalidated whenever the underlying database.TunnelPolicy
+// is written, so the hot request path never hits the database.
+package policy
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"sort"
+	"sync"
+
+	"github.com/charmbracelet/log"
+	"gorm.io/gorm"
+
+	"github.com/pgrok/pgrok/internal/database"
+)
+
+// Decision is the outcome of evaluating a policy against a request.
+type Decision int
+
+const (
+	// Allow means the request may proceed.
+	Allow Decision = iota
+	// Deny means the request must be rejected.
+	Deny
+	// RequireAuth means the request must complete the OIDC login flow
+	// before EvaluateClaims can decide Allow or Deny.
+	RequireAuth
+)
+
+func (d Decision) String() string {
+	switch d {
+	case Allow:
+		return "allow"
+	case Deny:
+		return "deny"
+	case RequireAuth:
+		return "require-auth"
+	default:
+		return "unknown"
+	}
+}
+
+// compiledCIDR pairs a parsed prefix with whether it allows or denies.
+type compiledCIDR struct {
+	prefix netip.Prefix
+	deny   bool
+}
+
+// Compiled is a TunnelPolicy compiled into a form cheap to evaluate on every
+// request.
+type Compiled struct {
+	tunnelID       int64
+	cidrs          []compiledCIDR // sorted by Prefix.Bits() descending
+	requireAuth    bool
+	allowedEmails  map[string]bool
+	allowedGroups  map[string]bool
+	allowedDomains map[string]bool
+}
+
+// Compile parses and sorts the CIDR rules of p so EvaluateCIDR can do a
+// single longest-prefix-match pass. Unparsable CIDRs are skipped.
+func Compile(p *database.TunnelPolicy) *Compiled {
+	c := &Compiled{
+		tunnelID:       p.TunnelID,
+		requireAuth:    p.RequireAuth,
+		allowedEmails:  toSet(p.AllowedEmails),
+		allowedGroups:  toSet(p.AllowedGroups),
+		allowedDomains: toSet(p.AllowedDomains),
+	}
+
+	for _, cidr := range p.AllowCIDRs {
+		if prefix, err := netip.ParsePrefix(cidr); err == nil {
+			c.cidrs = append(c.cidrs, compiledCIDR{prefix: prefix.Masked(), deny: false})
+		}
+	}
+	for _, cidr := range p.DenyCIDRs {
+		if prefix, err := netip.ParsePrefix(cidr); err == nil {
+			c.cidrs = append(c.cidrs, compiledCIDR{prefix: prefix.Masked(), deny: true})
+		}
+	}
+	// Longest prefix first; a deny wins a tie against an allow of the same
+	// length because it sorts after it and is therefore visited second,
+	// see EvaluateCIDR.
+	sort.SliceStable(c.cidrs, func(i, j int) bool {
+		return c.cidrs[i].prefix.Bits() > c.cidrs[j].prefix.Bits()
+	})
+	return c
+}
+
+func toSet(values []string) map[string]bool {
+	if len(values) == 0 {
+		return nil
+	}
+	set := make(map[string]bool, len(values))
+	for _, v := range values {
+		set[v] = true
+	}
+	return set
+}
+
+// EvaluateCIDR returns the CIDR-rule decision for addr: Deny if the
+// longest-prefix match is a deny rule; otherwise RequireAuth if
+// c.requireAuth is set (whether or not an allow rule matched), or Allow.
+// c.cidrs is sorted by prefix length descending with denies after allows of
+// the same length, and an allow match keeps scanning the rest of its length,
+// so a tie between an allow and a deny of the same length resolves to Deny.
+func (c *Compiled) EvaluateCIDR(addr netip.Addr) (decision Decision, matched string) {
+	bestBits := -1
+	for i := range c.cidrs {
+		rule := &c.cidrs[i]
+		if bestBits != -1 && rule.prefix.Bits() < bestBits {
+			break
+		}
+		if !rule.prefix.Contains(addr) {
+			continue
+		}
+		if rule.deny {
+			return Deny, rule.prefix.String()
+		}
+		bestBits = rule.prefix.Bits()
+		matched = rule.prefix.String()
+	}
+
+	if c.requireAuth {
+		return RequireAuth, matched
+	}
+	return Allow, matched
+}
+
+// EvaluateClaims checks an authenticated request's OIDC claims against the
+// policy's allowed emails, groups, and hosted domain ("hd" claim). If
+// AllowedEmails, AllowedGroups, and AllowedDomains are all empty, any
+// authenticated visitor is allowed; otherwise at least one claim must match
+// one of the configured lists.
+func (c *Compiled) EvaluateClaims(claims Claims) Decision {
+	if len(c.allowedEmails) == 0 && len(c.allowedGroups) == 0 && len(c.allowedDomains) == 0 {
+		return Allow
+	}
+	if c.allowedEmails[claims.Email] {
+		return Allow
+	}
+	if c.allowedDomains[claims.HostedDomain] {
+		return Allow
+	}
+	for _, group := range claims.Groups {
+		if c.allowedGroups[group] {
+			return Allow
+		}
+	}
+	return Deny
+}
+
+// Cache compiles and caches a TunnelPolicy per tunnel, so evaluating a
+// policy on the request path never touches the database. Invalidate must be
+// called after every write to database.TunnelPolicy.
+type Cache struct {
+	db *database.DB
+
+	mu       sync.RWMutex
+	compiled map[int64]*Compiled
+
+	invalidations chan int64
+}
+
+// NewCache creates a Cache backed by db and starts its invalidation loop.
+// Callers should not construct a Cache directly.
+func NewCache(db *database.DB) *Cache {
+	c := &Cache{
+		db:            db,
+		compiled:      make(map[int64]*Compiled),
+		invalidations: make(chan int64, 64),
+	}
+	go c.run()
+	return c
+}
+
+func (c *Cache) run() {
+	for tunnelID := range c.invalidations {
+		c.mu.Lock()
+		delete(c.compiled, tunnelID)
+		c.mu.Unlock()
+	}
+}
+
+// Invalidate evicts the cached policy for tunnelID, so the next Get
+// recompiles it from the database. Safe to call from an HTTP handler after
+// a policy write.
+func (c *Cache) Invalidate(tunnelID int64) {
+	c.invalidations <- tunnelID
+}
+
+// Get returns the compiled policy for tunnelID, loading and compiling it
+// from the database on a cache miss. A tunnel with no configured policy has
+// an implicit allow-all policy.
+func (c *Cache) Get(ctx context.Context, tunnelID int64) (*Compiled, error) {
+	c.mu.RLock()
+	compiled, ok := c.compiled[tunnelID]
+	c.mu.RUnlock()
+	if ok {
+		return compiled, nil
+	}
+
+	p, err := c.db.GetTunnelPolicyByTunnelID(ctx, tunnelID)
+	if err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			// Fail closed: don't cache an allow-all policy (or anything
+			// else) when we couldn't actually read it, so a transient DB
+			// error can't be mistaken for "no policy configured" and stick
+			// around after the database recovers.
+			return nil, err
+		}
+		p = &database.TunnelPolicy{TunnelID: tunnelID}
+	}
+	compiled = Compile(p)
+
+	c.mu.Lock()
+	c.compiled[tunnelID] = compiled
+	c.mu.Unlock()
+	return compiled, nil
+}
+
+// Audit logs an allow/deny decision for a tunnel request, so operators can
+// debug why traffic was rejected (or unexpectedly let through).
+func Audit(tunnelID int64, remoteAddr, stage string, decision Decision, reason string) {
+	log.Info("Tunnel policy decision",
+		"tunnelId", tunnelID,
+		"remoteAddr", remoteAddr,
+		"stage", stage,
+		"decision", decision.String(),
+		"reason", reason,
+	)
+}
@@ -0,0 +1,24 @@
+// Package strutil provides string generation and manipulation helpers.
+package strutil
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+)
+
+const randomChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// MustRandomChars returns a random string of n characters. It panics if the
+// underlying random source fails, which should never happen in practice.
+func MustRandomChars(n int) string {
+	buf := make([]byte, n)
+	for i := range buf {
+		idx, err := rand.Int(rand.Reader, big.NewInt(int64(len(randomChars))))
+		if err != nil {
+			panic(fmt.Sprintf("generate random char: %v", err))
+		}
+		buf[i] = randomChars[idx.Int64()]
+	}
+	return string(buf)
+}
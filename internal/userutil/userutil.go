@@ -0,0 +1,37 @@
+// Package userutil provides helpers for normalizing user-supplied identifiers.
+package userutil
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var subdomainPattern = regexp.MustCompile(`^[a-z0-9](?:[a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// NormalizeIdentifier normalizes the given identifier (e.g. an email address
+// or display name) into a value safe for use as a subdomain label: lowercase
+// ASCII letters, digits and hyphens only.
+func NormalizeIdentifier(identifier string) (string, error) {
+	s := strings.ToLower(identifier)
+	if at := strings.IndexByte(s, '@'); at >= 0 {
+		s = s[:at]
+	}
+
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			b.WriteRune(r)
+		case r == '.' || r == '_' || r == ' ':
+			b.WriteRune('-')
+		}
+	}
+
+	normalized := strings.Trim(b.String(), "-")
+	if !subdomainPattern.MatchString(normalized) {
+		return "", errors.Errorf("%q does not normalize to a valid subdomain label", identifier)
+	}
+	return normalized, nil
+}
@@ -0,0 +1,15 @@
+package vnet
+
+// ChannelType is the SSH channel type a pgrok client opens on its tunnel's
+// control connection to dispatch a single vnet-routed connection. pgrokd's
+// SSH server accepts it alongside a tunnel's regular channels: it reads the
+// ConnectPayload, looks up the connected control connection of the tunnel
+// with ID TunnelID (the client has already picked TunnelID with its own
+// routing Table), and relays the channel into that control connection.
+const ChannelType = "vnet-connect@pgrok"
+
+// ConnectPayload is the SSH channel-open payload for ChannelType.
+type ConnectPayload struct {
+	TunnelID uint64
+	Address  string
+}
@@ -0,0 +1,68 @@
+// Package vnet implements the routing table used to dispatch private
+// tunnel-to-tunnel traffic within a virtual network to the tunnel whose IP
+// route best matches the destination address.
+package vnet
+
+import (
+	"net/netip"
+	"sort"
+	"sync"
+
+	"github.com/pgrok/pgrok/internal/database"
+)
+
+// Route pairs a compiled CIDR prefix with the tunnel it directs traffic to.
+type Route struct {
+	Prefix   netip.Prefix
+	TunnelID int64
+}
+
+// Table is a longest-prefix-match routing table for a single virtual
+// network. It's safe for concurrent use; Reload compiles the new set of
+// routes before taking the write lock, so lookups are only blocked while it
+// swaps them in.
+type Table struct {
+	mu     sync.RWMutex
+	routes []Route // sorted by Prefix.Bits() descending, longest first
+}
+
+// NewTable builds a Table from the given IP routes, skipping any with an
+// unparsable CIDR.
+func NewTable(ipRoutes []*database.IPRoute) *Table {
+	t := &Table{}
+	t.Reload(ipRoutes)
+	return t
+}
+
+// Reload recompiles the table from the given IP routes.
+func (t *Table) Reload(ipRoutes []*database.IPRoute) {
+	routes := make([]Route, 0, len(ipRoutes))
+	for _, r := range ipRoutes {
+		prefix, err := netip.ParsePrefix(r.Network)
+		if err != nil {
+			continue
+		}
+		routes = append(routes, Route{Prefix: prefix.Masked(), TunnelID: r.TunnelID})
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		return routes[i].Prefix.Bits() > routes[j].Prefix.Bits()
+	})
+
+	t.mu.Lock()
+	t.routes = routes
+	t.mu.Unlock()
+}
+
+// LongestPrefixMatch returns the tunnel ID of the most specific route that
+// contains addr, and whether any route matched.
+func (t *Table) LongestPrefixMatch(addr netip.Addr) (tunnelID int64, ok bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	for _, r := range t.routes {
+		if r.Prefix.Contains(addr) {
+			return r.TunnelID, true
+		}
+	}
+	return 0, false
+}
@@ -14,6 +14,14 @@ type Profile struct {
 	ForwardAddr     string `yaml:"forward_addr,omitempty"`
 	Token           string `yaml:"token,omitempty"`
 	DynamicForwards string `yaml:"dynamic_forwards,omitempty"`
+
+	// VNetSOCKSAddr, like DynamicForwards, is a local address to listen on
+	// for dynamic SOCKS5 connections. Unlike DynamicForwards, upstreams
+	// aren't dialed directly: the destination address is resolved against
+	// the routing table fetched from the routes added with
+	// `pgrok vnet route add`, and the connection is dispatched to whichever
+	// tunnel owns the longest matching route (see internal/vnet).
+	VNetSOCKSAddr string `yaml:"vnet_socks_addr,omitempty"`
 }
 
 // Config represents the configuration file.
@@ -70,6 +78,9 @@ func (c *Config) ApplyProfile(name string) error {
 	if profile.DynamicForwards != "" {
 		c.DynamicForwards = profile.DynamicForwards
 	}
+	if profile.VNetSOCKSAddr != "" {
+		c.VNetSOCKSAddr = profile.VNetSOCKSAddr
+	}
 	return nil
 }
 
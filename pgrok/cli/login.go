@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"runtime"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/urfave/cli/v2"
+)
+
+func commandLogin(homeDir string) *cli.Command {
+	return &cli.Command{
+		Name:        "login",
+		Description: "Authorize this device to access a tunnel via your browser",
+		Action:      actionLogin,
+		Flags: append(
+			commonFlags(homeDir),
+			&cli.StringFlag{
+				Name:     "remote-addr",
+				Usage:    "The address of the remote SSH server",
+				Required: true,
+				Aliases:  []string{"r"},
+			},
+			&cli.StringFlag{
+				Name:     "tunnel",
+				Usage:    "The ID of the tunnel to authorize this device for",
+				Required: true,
+			},
+		),
+	}
+}
+
+// loopbackCallback is where pgrokd redirects the browser back to once the
+// user approves (or denies) the consent page.
+type loopbackCallback struct {
+	code  string
+	state string
+	err   error
+}
+
+func actionLogin(c *cli.Context) error {
+	remoteAddr := c.String("remote-addr")
+	tunnelID := c.String("tunnel")
+
+	codeVerifier := randomCodeVerifier()
+	codeChallenge := s256Challenge(codeVerifier)
+	state := randomCodeVerifier()
+
+	callbackCh := make(chan loopbackCallback, 1)
+	server, addr, err := startLoopbackServer(callbackCh)
+	if err != nil {
+		log.Fatal("Failed to start loopback server", "error", err.Error())
+		return err
+	}
+	defer func() { _ = server.Close() }()
+
+	authorizeURL := fmt.Sprintf(
+		"%s/-/authorize?response_type=code&client_id=pgrok-cli&redirect_uri=%s&state=%s&code_challenge=%s&code_challenge_method=S256&scope=%s",
+		remoteAddr,
+		url.QueryEscape(fmt.Sprintf("http://%s/callback", addr)),
+		url.QueryEscape(state),
+		url.QueryEscape(codeChallenge),
+		url.QueryEscape("tunnel:"+tunnelID),
+	)
+
+	log.Info("Opening browser to authorize this device", "url", authorizeURL)
+	if err := openBrowser(authorizeURL); err != nil {
+		log.Warn("Failed to open browser automatically, please open the URL manually", "url", authorizeURL)
+	}
+
+	var cb loopbackCallback
+	select {
+	case cb = <-callbackCh:
+	case <-time.After(5 * time.Minute):
+		return fmt.Errorf("timed out waiting for browser authorization")
+	}
+	if cb.err != nil {
+		return fmt.Errorf("authorization failed: %w", cb.err)
+	}
+	if cb.state != state {
+		return fmt.Errorf("mismatched state, want %q but got %q", state, cb.state)
+	}
+
+	accessToken, err := exchangeCodeForToken(context.Background(), remoteAddr, cb.code, codeVerifier)
+	if err != nil {
+		return fmt.Errorf("exchange code for token: %w", err)
+	}
+
+	configPath := c.String("config")
+	config, err := loadConfig(configPath)
+	if err != nil {
+		config = &Config{Profiles: make(map[string]*Profile)}
+	}
+
+	profileName := c.String("profile")
+	if profileName == "" {
+		config.RemoteAddr = remoteAddr
+		config.Token = accessToken
+	} else {
+		if config.Profiles[profileName] == nil {
+			config.Profiles[profileName] = &Profile{}
+		}
+		config.Profiles[profileName].RemoteAddr = remoteAddr
+		config.Profiles[profileName].Token = accessToken
+	}
+
+	if err := config.Save(configPath); err != nil {
+		log.Fatal("Failed to save config file", "path", configPath, "error", err.Error())
+		return err
+	}
+	log.Info("Device authorized, access token saved", "path", configPath)
+	return nil
+}
+
+// startLoopbackServer listens on an OS-assigned loopback port and delivers
+// the /callback redirect from pgrokd onto ch.
+func startLoopbackServer(ch chan<- loopbackCallback) (*http.Server, string, error) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/callback", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if errMsg := q.Get("error"); errMsg != "" {
+			ch <- loopbackCallback{err: fmt.Errorf("%s", errMsg)}
+		} else {
+			ch <- loopbackCallback{code: q.Get("code"), state: q.Get("state")}
+		}
+		_, _ = w.Write([]byte("Authorization complete, you can close this tab and return to the terminal."))
+	})
+
+	ln, err := newLoopbackListener()
+	if err != nil {
+		return nil, "", err
+	}
+	server := &http.Server{Handler: mux}
+	go func() { _ = server.Serve(ln) }()
+	return server, ln.Addr().String(), nil
+}
+
+// newLoopbackListener binds an OS-assigned port on the loopback interface.
+func newLoopbackListener() (net.Listener, error) {
+	return net.Listen("tcp", "127.0.0.1:0")
+}
+
+func exchangeCodeForToken(ctx context.Context, remoteAddr, code, codeVerifier string) (string, error) {
+	form := url.Values{
+		"code":          {code},
+		"code_verifier": {codeVerifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, remoteAddr+"/-/oauth/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.URL.RawQuery = form.Encode()
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("pgrokd returned status %d", resp.StatusCode)
+	}
+
+	var body struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	return body.AccessToken, nil
+}
+
+// randomCodeVerifier returns a random, URL-safe string suitable as a PKCE
+// code_verifier (RFC 7636 requires 43-128 characters; this yields 43).
+func randomCodeVerifier() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatal("Failed to generate random bytes", "error", err.Error())
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// s256Challenge computes the PKCE S256 code_challenge for the given verifier.
+func s256Challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// openBrowser opens url in the user's default browser.
+func openBrowser(url string) error {
+	switch runtime.GOOS {
+	case "darwin":
+		return exec.Command("open", url).Start()
+	case "windows":
+		return exec.Command("rundll32", "url.dll,FileProtocolHandler", url).Start()
+	default:
+		return exec.Command("xdg-open", url).Start()
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/charmbracelet/log"
+	"github.com/urfave/cli/v2"
+
+	"github.com/pgrok/pgrok/internal/vnet"
+)
+
+func commandVNet(homeDir string) *cli.Command {
+	return &cli.Command{
+		Name:        "vnet",
+		Description: "Manage private virtual network routes",
+		Subcommands: []*cli.Command{
+			commandVNetRoute(homeDir),
+			commandVNetConnect(homeDir),
+		},
+	}
+}
+
+func commandVNetConnect(homeDir string) *cli.Command {
+	return &cli.Command{
+		Name:        "connect",
+		Description: "Start the local SOCKS5 endpoint that routes traffic into your virtual network",
+		Action:      actionVNetConnect,
+		Flags:       commonFlags(homeDir),
+	}
+}
+
+func actionVNetConnect(c *cli.Context) error {
+	configPath := c.String("config")
+	config, err := loadConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("load config: %w", err)
+	}
+	if err := config.ApplyProfile(c.String("profile")); err != nil {
+		return err
+	}
+	if config.VNetSOCKSAddr == "" {
+		return fmt.Errorf("vnet_socks_addr is not configured for this profile")
+	}
+
+	sshClient, err := dialTunnelSSH(config.RemoteAddr, config.Token)
+	if err != nil {
+		return fmt.Errorf("dial remote SSH server: %w", err)
+	}
+	defer func() { _ = sshClient.Close() }()
+
+	table := vnet.NewTable(nil)
+	go pollVNetRoutes(config.RemoteAddr, config.Token, table)
+
+	log.Info("vnet connected, routing traffic per the routes added with `pgrok vnet route add`", "remoteAddr", config.RemoteAddr)
+	return startVNetSOCKSServer(config.VNetSOCKSAddr, sshClient, table)
+}
+
+func commandVNetRoute(homeDir string) *cli.Command {
+	return &cli.Command{
+		Name:        "route",
+		Description: "Manage IP routes within your default virtual network",
+		Subcommands: []*cli.Command{
+			{
+				Name:        "add",
+				Description: "Route a CIDR to a tunnel over the private virtual network",
+				ArgsUsage:   "<cidr>",
+				Action:      actionVNetRouteAdd,
+				Flags: append(
+					commonFlags(homeDir),
+					&cli.StringFlag{
+						Name:     "tunnel",
+						Usage:    "The name of the tunnel to route matching traffic to",
+						Required: true,
+					},
+				),
+			},
+		},
+	}
+}
+
+func actionVNetRouteAdd(c *cli.Context) error {
+	network := c.Args().First()
+	if network == "" {
+		return fmt.Errorf("missing <cidr> argument")
+	}
+
+	configPath := c.String("config")
+	config, err := loadConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("load config: %w", err)
+	}
+	if err := config.ApplyProfile(c.String("profile")); err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(map[string]string{
+		"network":    network,
+		"tunnelName": c.String("tunnel"),
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, config.RemoteAddr+"/api/vnets/default/routes", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+config.Token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("request pgrokd: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("pgrokd returned status %d", resp.StatusCode)
+	}
+	log.Info("Route added", "network", network, "tunnel", c.String("tunnel"))
+	return nil
+}
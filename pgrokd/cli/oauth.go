@@ -0,0 +1,315 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flamego/flamego"
+	"github.com/flamego/session"
+
+	"github.com/pgrok/pgrok/internal/cryptoutil"
+	"github.com/pgrok/pgrok/internal/database"
+	"github.com/pgrok/pgrok/internal/strutil"
+)
+
+// cliClientID is the only OAuth client this pgrokd instance issues codes to
+// today: the official pgrok CLI.
+const cliClientID = "pgrok-cli"
+
+// authorizationCodeTTL bounds how long a consent-approved code can be
+// exchanged for an access token before it must be re-requested.
+const authorizationCodeTTL = 5 * time.Minute
+
+// pendingAuthorization is what's stashed between a user approving the
+// consent page and the CLI exchanging the resulting code for a token.
+//
+// This is kept in memory rather than the database: codes are opaque,
+// single-use, and live for a few minutes at most, so there's nothing worth
+// persisting across a restart. In a multi-replica deployment the exchange
+// must land on the same replica that issued the code; pgrokd doesn't
+// sticky-route for this, and an exchange that lands elsewhere fails with
+// "invalid or expired code" (the CLI does not retry it).
+type pendingAuthorization struct {
+	tunnelID      int64
+	codeChallenge string
+	expiresAt     time.Time
+}
+
+var (
+	pendingAuthorizationsMu sync.Mutex
+	pendingAuthorizations   = map[string]*pendingAuthorization{}
+)
+
+func storePendingAuthorization(code string, p *pendingAuthorization) {
+	pendingAuthorizationsMu.Lock()
+	defer pendingAuthorizationsMu.Unlock()
+	pendingAuthorizations[code] = p
+}
+
+// takePendingAuthorization consumes (single-use) and returns the pending
+// authorization for code, evicting anything that's expired along the way.
+func takePendingAuthorization(code string) (*pendingAuthorization, bool) {
+	pendingAuthorizationsMu.Lock()
+	defer pendingAuthorizationsMu.Unlock()
+
+	now := time.Now()
+	for c, p := range pendingAuthorizations {
+		if now.After(p.expiresAt) {
+			delete(pendingAuthorizations, c)
+		}
+	}
+
+	p, ok := pendingAuthorizations[code]
+	if ok {
+		delete(pendingAuthorizations, code)
+	}
+	return p, ok
+}
+
+// registerOAuthRoutes mounts the authorization-code + PKCE flow (RFC 7636)
+// pgrok CLI uses to obtain a per-device access token scoped to a single
+// tunnel, replacing the long-lived, shared Tunnel.Token.
+func registerOAuthRoutes(f *flamego.Flame, db *database.DB, idps map[string]*idpRuntime) {
+	f.Get("/authorize", func(c flamego.Context, w http.ResponseWriter, s session.Session) {
+		userID, ok := s.Get("userID").(int64)
+		if !ok || userID <= 0 {
+			// chunk0-2 replaced the single /-/oidc/ route with one per
+			// identity provider, so there's no single "log in" page to send
+			// an unauthenticated `pgrok login` to: pick one the same way
+			// /-/policy/login does, and remember this request's URL so the
+			// OIDC callback can resume it once sign-in completes.
+			idp := policyLoginIdentityProvider(idps)
+			if idp == nil {
+				http.Error(w, "no identity provider is configured", http.StatusServiceUnavailable)
+				return
+			}
+
+			s.Set("authorize::return", "/-/authorize?"+c.Request().URL.RawQuery)
+
+			nonce := strutil.MustRandomChars(10)
+			s.Set("oidc::nonce", nonce)
+			http.Redirect(w, c.Request().Request, oidcAuthURL(idp, nonce), http.StatusFound)
+			return
+		}
+
+		q := c.Request().URL.Query()
+		if q.Get("client_id") != cliClientID {
+			http.Error(w, fmt.Sprintf("unknown client_id, want %q", cliClientID), http.StatusBadRequest)
+			return
+		}
+		if q.Get("response_type") != "code" {
+			http.Error(w, `unsupported response_type, want "code"`, http.StatusBadRequest)
+			return
+		}
+		if q.Get("code_challenge_method") != "S256" {
+			http.Error(w, `unsupported code_challenge_method, want "S256"`, http.StatusBadRequest)
+			return
+		}
+
+		if !isLoopbackRedirectURI(q.Get("redirect_uri")) {
+			http.Error(w, "redirect_uri must be the CLI's loopback callback", http.StatusBadRequest)
+			return
+		}
+
+		tunnelID, scopeOK := parseTunnelScope(q.Get("scope"))
+		if !scopeOK {
+			http.Error(w, `invalid scope, want "tunnel:<id>"`, http.StatusBadRequest)
+			return
+		}
+
+		tunnel, err := db.GetTunnelByID(c.Request().Context(), tunnelID)
+		if err != nil || tunnel.PrincipalID != userID {
+			http.Error(w, "tunnel not found", http.StatusNotFound)
+			return
+		}
+
+		renderConsentPage(w, consentPageData{
+			TunnelName:    tunnel.Name,
+			Scope:         q.Get("scope"),
+			ClientID:      q.Get("client_id"),
+			RedirectURI:   q.Get("redirect_uri"),
+			State:         q.Get("state"),
+			CodeChallenge: q.Get("code_challenge"),
+		})
+	})
+
+	f.Post("/authorize", func(c flamego.Context, w http.ResponseWriter, s session.Session) {
+		userID, ok := s.Get("userID").(int64)
+		if !ok || userID <= 0 {
+			http.Error(w, "not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		r := c.Request().Request
+		_ = r.ParseForm()
+
+		redirectURI := r.FormValue("redirect_uri")
+		state := r.FormValue("state")
+
+		// redirect_uri is attacker-controlled form input, not something
+		// pgrokd itself chose: without this check a malicious consent-page
+		// link could redirect the authorization code (or the deny error) to
+		// an arbitrary origin instead of the CLI's own loopback listener.
+		if !isLoopbackRedirectURI(redirectURI) {
+			http.Error(w, "redirect_uri must be the CLI's loopback callback", http.StatusBadRequest)
+			return
+		}
+
+		if r.FormValue("decision") != "approve" {
+			http.Redirect(w, r, redirectURI+"?error=access_denied&state="+state, http.StatusFound)
+			return
+		}
+
+		tunnelID, scopeOK := parseTunnelScope(r.FormValue("scope"))
+		if !scopeOK {
+			http.Error(w, `invalid scope, want "tunnel:<id>"`, http.StatusBadRequest)
+			return
+		}
+
+		tunnel, err := db.GetTunnelByID(r.Context(), tunnelID)
+		if err != nil || tunnel.PrincipalID != userID {
+			http.Error(w, "tunnel not found", http.StatusNotFound)
+			return
+		}
+
+		code := strutil.MustRandomChars(32)
+		storePendingAuthorization(code, &pendingAuthorization{
+			tunnelID:      tunnelID,
+			codeChallenge: r.FormValue("code_challenge"),
+			expiresAt:     time.Now().Add(authorizationCodeTTL),
+		})
+
+		http.Redirect(w, r, fmt.Sprintf("%s?code=%s&state=%s", redirectURI, code, state), http.StatusFound)
+	})
+
+	f.Post("/oauth/token", func(c flamego.Context, w http.ResponseWriter) {
+		r := c.Request().Request
+		_ = r.ParseForm()
+
+		code := r.FormValue("code")
+		codeVerifier := r.FormValue("code_verifier")
+
+		pending, ok := takePendingAuthorization(code)
+		if !ok {
+			http.Error(w, "invalid or expired code", http.StatusBadRequest)
+			return
+		}
+		if !verifyPKCE(pending.codeChallenge, codeVerifier) {
+			http.Error(w, "code_verifier does not match code_challenge", http.StatusBadRequest)
+			return
+		}
+
+		accessToken := strutil.MustRandomChars(40)
+		_, err := db.CreateTunnelToken(r.Context(), database.CreateTunnelTokenOptions{
+			TunnelID:  pending.tunnelID,
+			TokenHash: hashAccessToken(accessToken),
+			Label:     "Issued via CLI login on " + time.Now().UTC().Format(time.RFC3339),
+		})
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to create tunnel token: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"access_token": accessToken,
+			"token_type":   "Bearer",
+		})
+	})
+}
+
+// isLoopbackRedirectURI reports whether uri is the kind of redirect_uri the
+// pgrok CLI hands /authorize: a plain-HTTP URI on an OS-assigned loopback
+// port with path "/callback" (see startLoopbackServer in pgrok/cli/login.go).
+// Anything else is rejected so the authorization code (or consent denial)
+// can't be redirected to an attacker-chosen origin.
+func isLoopbackRedirectURI(uri string) bool {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "http" || u.Path != "/callback" {
+		return false
+	}
+	ip := net.ParseIP(u.Hostname())
+	return ip != nil && ip.IsLoopback()
+}
+
+// parseTunnelScope parses a scope string of the form "tunnel:<id>".
+func parseTunnelScope(scope string) (int64, bool) {
+	id, ok := strings.CutPrefix(scope, "tunnel:")
+	if !ok {
+		return 0, false
+	}
+	tunnelID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil || tunnelID <= 0 {
+		return 0, false
+	}
+	return tunnelID, true
+}
+
+// hashAccessToken returns the hex-encoded SHA-256 hash stored in place of
+// the opaque access token, so a leaked database dump doesn't hand out valid
+// credentials.
+func hashAccessToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return fmt.Sprintf("%x", sum)
+}
+
+// verifyPKCE checks SHA256(codeVerifier) == codeChallenge per RFC 7636's S256
+// method, in constant time.
+func verifyPKCE(codeChallenge, codeVerifier string) bool {
+	if codeChallenge == "" || codeVerifier == "" {
+		return false
+	}
+	computed := cryptoutil.Base64URLEncode(cryptoutil.SHA256(codeVerifier))
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(codeChallenge)) == 1
+}
+
+type consentPageData struct {
+	TunnelName    string
+	Scope         string
+	ClientID      string
+	RedirectURI   string
+	State         string
+	CodeChallenge string
+}
+
+// consentPageTemplate renders the consent page. Every field of
+// consentPageData except TunnelName comes from the request's query string
+// (State and CodeChallenge are entirely attacker-controlled), and TunnelName
+// is user-chosen, so this relies on
+// html/template's context-aware auto-escaping rather than interpolating
+// them into the HTML directly.
+var consentPageTemplate = template.Must(template.New("consent").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Authorize pgrok CLI</title></head>
+<body>
+	<h1>Authorize pgrok CLI</h1>
+	<p>{{.ClientID}} would like to access tunnel <strong>{{.TunnelName}}</strong>.</p>
+	<form method="POST" action="/-/authorize">
+		<input type="hidden" name="scope" value="{{.Scope}}">
+		<input type="hidden" name="redirect_uri" value="{{.RedirectURI}}">
+		<input type="hidden" name="state" value="{{.State}}">
+		<input type="hidden" name="code_challenge" value="{{.CodeChallenge}}">
+		<button type="submit" name="decision" value="approve">Approve</button>
+		<button type="submit" name="decision" value="deny">Deny</button>
+	</form>
+</body>
+</html>`))
+
+// renderConsentPage renders a minimal HTML page asking the signed-in user to
+// approve or deny the CLI's request for access to a single tunnel.
+func renderConsentPage(w http.ResponseWriter, d consentPageData) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := consentPageTemplate.Execute(w, d); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to render consent page: %v", err), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+
+	"github.com/pgrok/pgrok/internal/acme"
+	"github.com/pgrok/pgrok/internal/conf"
+	"github.com/pgrok/pgrok/internal/database"
+	"github.com/pgrok/pgrok/internal/policy"
+)
+
+// policyCookieName is the cookie a visitor's browser carries once it's
+// completed the OIDC login required by a RequireAuth policy. Its value is
+// the same signed token minted by policy.SignSubdomainCookie, so verifying
+// it back is just policy.VerifySubdomainCookie again.
+const policyCookieName = "pgrok_policy_auth"
+
+// policyCookieTTL is how long a completed policy login is remembered before
+// the visitor has to go through the OIDC flow again.
+const policyCookieTTL = 12 * time.Hour
+
+// ProxyServer is the tunnel-facing HTTP endpoint: every request for
+// <subdomain>.<Proxy.Domain> arrives here, and it's where the per-tunnel
+// access policy set up by PUT /tunnels/{id}/policy is enforced. It does not
+// forward requests into the tunnel's SSH connection: a request that clears
+// the policy is answered with 501 Not Implemented.
+type ProxyServer struct {
+	config           *conf.Config
+	db               *database.DB
+	policyCache      *policy.Cache
+	policyAuthSecret []byte
+}
+
+// NewProxyServer creates a ProxyServer. policyAuthSecret must be the same
+// secret startWebServer uses to sign the policy login cookie in the
+// /-/oidc/{id}/callback handler, or a cookie minted there will never verify
+// here.
+func NewProxyServer(config *conf.Config, db *database.DB, policyCache *policy.Cache, policyAuthSecret []byte) *ProxyServer {
+	return &ProxyServer{
+		config:           config,
+		db:               db,
+		policyCache:      policyCache,
+		policyAuthSecret: policyAuthSecret,
+	}
+}
+
+// Start listens on config.Proxy.Port and serves ProxyServer.ServeHTTP. If
+// acmeManager is non-nil, the listener terminates TLS with its hot-reloaded
+// certificate; otherwise it serves plain HTTP, e.g. for local development
+// behind a separate TLS-terminating load balancer.
+func (p *ProxyServer) Start(acmeManager *acme.Manager) error {
+	address := fmt.Sprintf("0.0.0.0:%d", p.config.Proxy.Port)
+	log.Info("Tunnel proxy listening on", "address", address)
+
+	if acmeManager == nil {
+		return http.ListenAndServe(address, p)
+	}
+
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("listen on %q: %w", address, err)
+	}
+	tlsLn := tls.NewListener(ln, &tls.Config{GetCertificate: acmeManager.GetCertificate})
+	return http.Serve(tlsLn, p)
+}
+
+func (p *ProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/-/policy/callback" {
+		p.servePolicyCallback(w, r)
+		return
+	}
+
+	subdomain, ok := subdomainFromHost(r.Host, p.config.Proxy.Domain)
+	if !ok {
+		http.Error(w, "unrecognized host", http.StatusNotFound)
+		return
+	}
+
+	tunnel, err := p.db.GetTunnelBySubdomain(r.Context(), subdomain)
+	if err != nil {
+		http.Error(w, "tunnel not found", http.StatusNotFound)
+		return
+	}
+
+	compiled, err := p.policyCache.Get(r.Context(), tunnel.ID)
+	if err != nil {
+		log.Error("Failed to load tunnel policy", "tunnelId", tunnel.ID, "error", err)
+		http.Error(w, "failed to evaluate access policy", http.StatusInternalServerError)
+		return
+	}
+
+	addr, ok := remoteAddr(r)
+	if !ok {
+		http.Error(w, "could not determine remote address", http.StatusBadRequest)
+		return
+	}
+
+	decision, matched := compiled.EvaluateCIDR(addr)
+	policy.Audit(tunnel.ID, r.RemoteAddr, "cidr", decision, matched)
+	switch decision {
+	case policy.Deny:
+		http.Error(w, "forbidden by tunnel access policy", http.StatusForbidden)
+		return
+	case policy.RequireAuth:
+		claims, ok := p.verifyPolicyCookie(r, subdomain)
+		if !ok {
+			p.redirectToLogin(w, r, subdomain)
+			return
+		}
+		claimsDecision := compiled.EvaluateClaims(claims)
+		policy.Audit(tunnel.ID, r.RemoteAddr, "claims", claimsDecision, claims.Email)
+		if claimsDecision != policy.Allow {
+			http.Error(w, "forbidden by tunnel access policy", http.StatusForbidden)
+			return
+		}
+	case policy.Allow:
+		// Fall through to forwarding.
+	}
+
+	// The request has cleared the tunnel's access policy. ProxyServer holds
+	// no reference to SSHServer's registry of connected tunnels, so it does
+	// not forward the request into the tunnel's SSH connection; everything
+	// above this comment runs for every request and is what the access
+	// policy gates.
+	http.Error(w, "tunnel is authorized but request forwarding is not implemented", http.StatusNotImplemented)
+}
+
+// redirectToLogin sends an unauthenticated visitor to the dashboard's OIDC
+// login, tagged with enough state (subdomain and the original URL) for
+// /-/oidc/{id}/callback to mint a policy cookie scoped to this subdomain and
+// bounce the visitor back here.
+func (p *ProxyServer) redirectToLogin(w http.ResponseWriter, r *http.Request, subdomain string) {
+	returnTo := p.config.Proxy.Scheme + "://" + r.Host + r.URL.RequestURI()
+	loginURL := fmt.Sprintf("%s/-/policy/login?subdomain=%s&return=%s",
+		p.config.ExternalURL,
+		url.QueryEscape(subdomain),
+		url.QueryEscape(returnTo),
+	)
+	http.Redirect(w, r, loginURL, http.StatusFound)
+}
+
+// servePolicyCallback completes the handoff from /-/oidc/{id}/callback on
+// the dashboard host: it verifies the signed token that callback minted,
+// sets it as this subdomain's policy cookie, and sends the visitor on to
+// the URL they originally requested.
+func (p *ProxyServer) servePolicyCallback(w http.ResponseWriter, r *http.Request) {
+	subdomain, ok := subdomainFromHost(r.Host, p.config.Proxy.Domain)
+	if !ok {
+		http.Error(w, "unrecognized host", http.StatusNotFound)
+		return
+	}
+
+	token := r.URL.Query().Get("token")
+	if _, ok := policy.VerifySubdomainCookie(p.policyAuthSecret, subdomain, token); !ok {
+		http.Error(w, "invalid or expired login", http.StatusForbidden)
+		return
+	}
+
+	returnTo := r.URL.Query().Get("return")
+	returnHost, ok := subdomainFromHost(hostOf(returnTo), p.config.Proxy.Domain)
+	if !ok || returnHost != subdomain {
+		http.Error(w, "invalid return URL", http.StatusBadRequest)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     policyCookieName,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   p.config.Proxy.Scheme == "https",
+		SameSite: http.SameSiteLaxMode,
+		Expires:  time.Now().Add(policyCookieTTL),
+	})
+	http.Redirect(w, r, returnTo, http.StatusFound)
+}
+
+func (p *ProxyServer) verifyPolicyCookie(r *http.Request, subdomain string) (policy.Claims, bool) {
+	cookie, err := r.Cookie(policyCookieName)
+	if err != nil {
+		return policy.Claims{}, false
+	}
+	return policy.VerifySubdomainCookie(p.policyAuthSecret, subdomain, cookie.Value)
+}
+
+// subdomainFromHost extracts the leading label of host when it's a
+// subdomain of domain, e.g. ("foo.tunnels.example.com", "tunnels.example.com")
+// returns ("foo", true).
+func subdomainFromHost(host, domain string) (string, bool) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	suffix := "." + domain
+	if !strings.HasSuffix(host, suffix) {
+		return "", false
+	}
+	return strings.TrimSuffix(host, suffix), true
+}
+
+// hostOf returns the host component of rawURL, or "" if it doesn't parse.
+func hostOf(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// remoteAddr extracts the caller's IP from r.RemoteAddr for policy CIDR
+// evaluation.
+func remoteAddr(r *http.Request) (netip.Addr, bool) {
+	return parseRemoteAddr(r.RemoteAddr)
+}
+
+// parseRemoteAddr extracts the IP out of a "host:port" (or bare host) string
+// such as net.Conn.RemoteAddr().String(), for policy CIDR evaluation. Shared
+// by ProxyServer and SSHServer, whose callers start from an *http.Request
+// and a net.Conn respectively.
+func parseRemoteAddr(hostport string) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/charmbracelet/log"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/pgrok/pgrok/internal/conf"
+	"github.com/pgrok/pgrok/internal/database"
+	"github.com/pgrok/pgrok/internal/policy"
+	"github.com/pgrok/pgrok/internal/vnet"
+)
+
+// tcpipForwardPayload is the payload of a "tcpip-forward" global request
+// (RFC 4254 §7.1), sent by a client asking the server to listen on its
+// behalf and forward accepted connections back over the control channel.
+type tcpipForwardPayload struct {
+	BindAddr string
+	BindPort uint32
+}
+
+// tcpipForwardReply is the success reply to a tcpip-forward request whose
+// BindPort was 0, reporting the port the server actually bound.
+type tcpipForwardReply struct {
+	BoundPort uint32
+}
+
+// forwardedTCPPayload is the channel-open payload for a "forwarded-tcpip"
+// channel (RFC 4254 §7.2): the server relaying a connection it accepted on
+// behalf of a tcpip-forward request back to the client that requested it.
+type forwardedTCPPayload struct {
+	ConnectedAddr string
+	ConnectedPort uint32
+	OriginAddr    string
+	OriginPort    uint32
+}
+
+// sshControlConn is a tunnel's authenticated, long-lived control
+// connection: the SSH connection a running `pgrok` client keeps open for
+// as long as its tunnel is up.
+type sshControlConn struct {
+	tunnel *database.Tunnel
+	conn   *ssh.ServerConn
+}
+
+// SSHServer is the SSH endpoint tunnel clients authenticate against and
+// stay connected to.
+type SSHServer struct {
+	config      *conf.Config
+	db          *database.DB
+	policyCache *policy.Cache
+
+	signer ssh.Signer
+
+	mu       sync.RWMutex
+	controls map[int64]*sshControlConn // tunnelID -> control connection
+}
+
+// NewSSHServer creates an SSHServer with a freshly generated host key. The
+// key isn't persisted, so it changes across restarts; nothing in this tree
+// pins pgrokd's host key on the client side yet (see the matching comment
+// on dialTunnelSSH in pgrok/cli/vnet_socks.go), so this doesn't regress
+// anything that currently checks it.
+func NewSSHServer(config *conf.Config, db *database.DB, policyCache *policy.Cache) (*SSHServer, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generate host key: %w", err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		return nil, fmt.Errorf("create signer: %w", err)
+	}
+
+	return &SSHServer{
+		config:      config,
+		db:          db,
+		policyCache: policyCache,
+		signer:      signer,
+		controls:    make(map[int64]*sshControlConn),
+	}, nil
+}
+
+// Start listens on config.SSH.Port and authenticates every connection
+// against a tunnel's access token, blocking until the listener fails.
+func (s *SSHServer) Start() error {
+	address := fmt.Sprintf("0.0.0.0:%d", s.config.SSH.Port)
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("listen on %q: %w", address, err)
+	}
+	log.Info("SSH server listening on", "address", address)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return fmt.Errorf("accept: %w", err)
+		}
+		go s.handleConn(conn)
+	}
+}
+
+func (s *SSHServer) handleConn(conn net.Conn) {
+	var authed *database.Tunnel
+	serverConfig := &ssh.ServerConfig{
+		PasswordCallback: func(_ ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			tunnel, tunnelToken, err := s.db.GetTunnelByAuthToken(context.Background(), hashAccessToken(string(password)), string(password))
+			if err != nil {
+				return nil, fmt.Errorf("unknown tunnel token")
+			}
+			if tunnelToken != nil {
+				if err := s.db.TouchTunnelTokenLastUsed(context.Background(), tunnelToken.ID); err != nil {
+					log.Error("Failed to touch tunnel token last used", "tunnelTokenId", tunnelToken.ID, "error", err)
+				}
+			}
+			authed = tunnel
+			return nil, nil
+		},
+	}
+	serverConfig.AddHostKey(s.signer)
+
+	sshConn, chans, reqs, err := ssh.NewServerConn(conn, serverConfig)
+	if err != nil {
+		_ = conn.Close()
+		log.Warn("SSH handshake failed", "remoteAddr", conn.RemoteAddr().String(), "error", err.Error())
+		return
+	}
+	defer func() { _ = sshConn.Close() }()
+
+	control := &sshControlConn{tunnel: authed, conn: sshConn}
+	s.registerControl(control)
+	defer s.unregisterControl(control.tunnel.ID)
+	log.Info("Tunnel connected", "tunnelId", control.tunnel.ID, "subdomain", control.tunnel.Subdomain)
+
+	go s.handleGlobalRequests(control, reqs)
+	for newChannel := range chans {
+		s.handleChannel(control, newChannel)
+	}
+}
+
+func (s *SSHServer) registerControl(c *sshControlConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.controls[c.tunnel.ID] = c
+}
+
+func (s *SSHServer) unregisterControl(tunnelID int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.controls, tunnelID)
+}
+
+func (s *SSHServer) lookupControl(tunnelID int64) (*sshControlConn, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	c, ok := s.controls[tunnelID]
+	return c, ok
+}
+
+// handleGlobalRequests services the control connection's global (non-
+// channel) requests, the only one of which this server understands being
+// tcpip-forward.
+func (s *SSHServer) handleGlobalRequests(control *sshControlConn, reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		if req.Type != "tcpip-forward" {
+			if req.WantReply {
+				_ = req.Reply(false, nil)
+			}
+			continue
+		}
+		s.handleTCPIPForward(control, req)
+	}
+}
+
+// handleTCPIPForward binds a listener on behalf of a tcpip-forward request
+// and starts relaying the raw TCP connections accepted on it, subject to
+// the tunnel's access policy.
+func (s *SSHServer) handleTCPIPForward(control *sshControlConn, req *ssh.Request) {
+	var payload tcpipForwardPayload
+	if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+		if req.WantReply {
+			_ = req.Reply(false, nil)
+		}
+		return
+	}
+
+	ln, err := net.Listen("tcp", net.JoinHostPort(payload.BindAddr, strconv.Itoa(int(payload.BindPort))))
+	if err != nil {
+		log.Error("Failed to bind requested TCP forward", "tunnelId", control.tunnel.ID, "error", err.Error())
+		if req.WantReply {
+			_ = req.Reply(false, nil)
+		}
+		return
+	}
+
+	boundPort := ln.Addr().(*net.TCPAddr).Port
+	if err := s.db.UpdateTunnelLastTCPPort(context.Background(), control.tunnel.ID, boundPort); err != nil {
+		log.Error("Failed to persist tunnel's last TCP port", "tunnelId", control.tunnel.ID, "error", err.Error())
+	}
+
+	if req.WantReply {
+		_ = req.Reply(true, ssh.Marshal(&tcpipForwardReply{BoundPort: uint32(boundPort)}))
+	}
+
+	go s.acceptForwardedConns(control, ln, boundPort)
+}
+
+func (s *SSHServer) acceptForwardedConns(control *sshControlConn, ln net.Listener, boundPort int) {
+	defer func() { _ = ln.Close() }()
+	for {
+		visitorConn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.handleForwardedConn(control, visitorConn, boundPort)
+	}
+}
+
+// handleForwardedConn is the raw-TCP tunnel's accept path: it's where a
+// tunnel's access policy (the same one ProxyServer enforces for HTTP) gets
+// applied to a plain TCP visitor, before the connection is ever relayed
+// into the client.
+func (s *SSHServer) handleForwardedConn(control *sshControlConn, visitorConn net.Conn, boundPort int) {
+	defer func() { _ = visitorConn.Close() }()
+
+	addr, ok := parseRemoteAddr(visitorConn.RemoteAddr().String())
+	if !ok {
+		return
+	}
+
+	compiled, err := s.policyCache.Get(context.Background(), control.tunnel.ID)
+	if err != nil {
+		log.Error("Failed to load tunnel policy", "tunnelId", control.tunnel.ID, "error", err)
+		return
+	}
+
+	decision, matched := compiled.EvaluateCIDR(addr)
+	policy.Audit(control.tunnel.ID, visitorConn.RemoteAddr().String(), "tcp", decision, matched)
+	if decision != policy.Allow {
+		// A raw TCP connection can't complete an OIDC redirect, so
+		// RequireAuth is treated the same as Deny here: fail closed rather
+		// than let an unauthenticated visitor through.
+		return
+	}
+
+	originHost, originPortStr, _ := net.SplitHostPort(visitorConn.RemoteAddr().String())
+	originPort, _ := strconv.Atoi(originPortStr)
+
+	channel, reqs, err := control.conn.OpenChannel("forwarded-tcpip", ssh.Marshal(&forwardedTCPPayload{
+		ConnectedAddr: "0.0.0.0",
+		ConnectedPort: uint32(boundPort),
+		OriginAddr:    originHost,
+		OriginPort:    uint32(originPort),
+	}))
+	if err != nil {
+		log.Warn("Tunnel rejected forwarded connection", "tunnelId", control.tunnel.ID, "error", err.Error())
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	defer func() { _ = channel.Close() }()
+
+	relay(visitorConn, channel)
+}
+
+// handleChannel services a channel-open request on an authenticated
+// control connection. The only channel type this server accepts is
+// vnet.ChannelType, dispatching one end of a vnet-routed connection into
+// the destination tunnel's own control connection.
+func (s *SSHServer) handleChannel(control *sshControlConn, newChannel ssh.NewChannel) {
+	if newChannel.ChannelType() != vnet.ChannelType {
+		_ = newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+		return
+	}
+
+	var payload vnet.ConnectPayload
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &payload); err != nil {
+		_ = newChannel.Reject(ssh.ConnectionFailed, "malformed vnet-connect payload")
+		return
+	}
+
+	dest, ok := s.lookupControl(int64(payload.TunnelID))
+	if !ok {
+		_ = newChannel.Reject(ssh.ConnectionFailed, "destination tunnel is not connected")
+		return
+	}
+
+	sourceChannel, sourceReqs, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(sourceReqs)
+	defer func() { _ = sourceChannel.Close() }()
+
+	destChannel, destReqs, err := dest.conn.OpenChannel(vnet.ChannelType, ssh.Marshal(&vnet.ConnectPayload{
+		Address: payload.Address,
+	}))
+	if err != nil {
+		log.Warn("vnet: destination tunnel rejected connection", "tunnelId", payload.TunnelID, "error", err.Error())
+		return
+	}
+	go ssh.DiscardRequests(destReqs)
+	defer func() { _ = destChannel.Close() }()
+
+	policy.Audit(dest.tunnel.ID, control.tunnel.Subdomain, "vnet", policy.Allow, payload.Address)
+	relay(sourceChannel, destChannel)
+}
+
+// relay copies bytes in both directions between a and b until either side
+// closes.
+func relay(a io.ReadWriter, b io.ReadWriter) {
+	done := make(chan struct{}, 2)
+	go func() { _, _ = io.Copy(a, b); done <- struct{}{} }()
+	go func() { _, _ = io.Copy(b, a); done <- struct{}{} }()
+	<-done
+}
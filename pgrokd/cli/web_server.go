@@ -9,6 +9,7 @@ import (
 	"io/fs"
 	"net/http"
 	"net/http/httputil"
+	"net/netip"
 	"net/url"
 	"strconv"
 	"strings"
@@ -21,9 +22,11 @@ import (
 	"github.com/pkg/errors"
 	"golang.org/x/oauth2"
 
+	"github.com/pgrok/pgrok/internal/acme"
 	"github.com/pgrok/pgrok/internal/conf"
 	"github.com/pgrok/pgrok/internal/cryptoutil"
 	"github.com/pgrok/pgrok/internal/database"
+	"github.com/pgrok/pgrok/internal/policy"
 	"github.com/pgrok/pgrok/internal/strutil"
 	"github.com/pgrok/pgrok/internal/userutil"
 )
@@ -118,6 +121,12 @@ func startWebServer(config *conf.Config, db *database.DB) {
 		},
 	))
 
+	// policyCache compiles each tunnel's access policy on first use and is
+	// invalidated by the PUT /tunnels/{id}/policy handler below. The proxy's
+	// request path and the SSH channel accept path (see Tunnel.LastTCPPort)
+	// both consult it to decide whether to let a connection through.
+	policyCache := policy.NewCache(db)
+
 	// Behind authentication
 	f.Group("/api",
 		func() {
@@ -238,8 +247,315 @@ func startWebServer(config *conf.Config, db *database.DB) {
 					"url":       config.Proxy.Scheme + "://" + subdomain + "." + config.Proxy.Domain,
 				})
 			})
+
+			f.Get("/tunnels/{id}/policy", func(c flamego.Context, r flamego.Render, principle *database.Principal) {
+				id, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+				t, err := db.GetTunnelByID(c.Request().Context(), id)
+				if err != nil || t.PrincipalID != principle.ID {
+					r.PlainText(http.StatusNotFound, "Tunnel not found")
+					return
+				}
+
+				p, err := db.GetTunnelPolicyByTunnelID(c.Request().Context(), id)
+				if err != nil {
+					// No policy configured yet is not an error; report the
+					// implicit allow-all default.
+					p = &database.TunnelPolicy{TunnelID: id}
+				}
+				r.JSON(http.StatusOK, p)
+			})
+
+			f.Put("/tunnels/{id}/policy", func(c flamego.Context, r flamego.Render, principle *database.Principal) {
+				id, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+				t, err := db.GetTunnelByID(c.Request().Context(), id)
+				if err != nil || t.PrincipalID != principle.ID {
+					r.PlainText(http.StatusNotFound, "Tunnel not found")
+					return
+				}
+
+				var form struct {
+					AllowCIDRs     []string `json:"allowCidrs"`
+					DenyCIDRs      []string `json:"denyCidrs"`
+					RequireAuth    bool     `json:"requireAuth"`
+					AllowedEmails  []string `json:"allowedEmails"`
+					AllowedGroups  []string `json:"allowedGroups"`
+					AllowedDomains []string `json:"allowedDomains"`
+				}
+				if err := json.NewDecoder(c.Request().Request.Body).Decode(&form); err != nil {
+					r.PlainText(http.StatusBadRequest, "Invalid request body")
+					return
+				}
+				for _, cidr := range append(append([]string{}, form.AllowCIDRs...), form.DenyCIDRs...) {
+					if _, err := netip.ParsePrefix(cidr); err != nil {
+						r.PlainText(http.StatusBadRequest, fmt.Sprintf("Invalid CIDR %q: %v", cidr, err))
+						return
+					}
+				}
+
+				p, err := db.UpsertTunnelPolicy(c.Request().Context(), database.UpsertTunnelPolicyOptions{
+					TunnelID:       id,
+					AllowCIDRs:     form.AllowCIDRs,
+					DenyCIDRs:      form.DenyCIDRs,
+					RequireAuth:    form.RequireAuth,
+					AllowedEmails:  form.AllowedEmails,
+					AllowedGroups:  form.AllowedGroups,
+					AllowedDomains: form.AllowedDomains,
+				})
+				if err != nil {
+					r.PlainText(http.StatusInternalServerError, fmt.Sprintf("Failed to save tunnel policy: %v", err))
+					return
+				}
+				policyCache.Invalidate(id)
+				r.JSON(http.StatusOK, p)
+			})
+
+			f.Get("/tunnels/{id}/tokens", func(c flamego.Context, r flamego.Render, principle *database.Principal) {
+				id, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+				t, err := db.GetTunnelByID(c.Request().Context(), id)
+				if err != nil || t.PrincipalID != principle.ID {
+					r.PlainText(http.StatusNotFound, "Tunnel not found")
+					return
+				}
+
+				tokens, err := db.GetTunnelTokensByTunnelID(c.Request().Context(), id)
+				if err != nil {
+					r.PlainText(http.StatusInternalServerError, fmt.Sprintf("Failed to get tunnel tokens: %v", err))
+					return
+				}
+				r.JSON(http.StatusOK, tokens)
+			})
+
+			f.Delete("/tunnels/{id}/tokens/{tokenID}", func(c flamego.Context, r flamego.Render, principle *database.Principal) {
+				id, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+				tokenID, _ := strconv.ParseInt(c.Param("tokenID"), 10, 64)
+
+				t, err := db.GetTunnelByID(c.Request().Context(), id)
+				if err != nil || t.PrincipalID != principle.ID {
+					r.PlainText(http.StatusNotFound, "Tunnel not found")
+					return
+				}
+
+				err = db.DeleteTunnelTokenByID(c.Request().Context(), tokenID, id)
+				if err != nil {
+					r.PlainText(http.StatusInternalServerError, fmt.Sprintf("Failed to revoke tunnel token: %v", err))
+					return
+				}
+				r.PlainText(http.StatusOK, "OK")
+			})
+
+			f.Get("/vnets", func(c flamego.Context, r flamego.Render, principle *database.Principal) {
+				vnets, err := db.GetVirtualNetworksByPrincipalID(c.Request().Context(), principle.ID)
+				if err != nil {
+					r.PlainText(http.StatusInternalServerError, fmt.Sprintf("Failed to get virtual networks: %v", err))
+					return
+				}
+				r.JSON(http.StatusOK, vnets)
+			})
+
+			f.Post("/vnets", func(c flamego.Context, r flamego.Render, principle *database.Principal) {
+				var form struct {
+					Name      string `json:"name"`
+					Comment   string `json:"comment"`
+					IsDefault bool   `json:"isDefault"`
+				}
+				if err := json.NewDecoder(c.Request().Request.Body).Decode(&form); err != nil {
+					r.PlainText(http.StatusBadRequest, "Invalid request body")
+					return
+				}
+
+				vnet, err := db.CreateVirtualNetwork(c.Request().Context(), database.CreateVirtualNetworkOptions{
+					PrincipalID: principle.ID,
+					Name:        form.Name,
+					Comment:     form.Comment,
+					IsDefault:   form.IsDefault,
+				})
+				if err != nil {
+					r.PlainText(http.StatusInternalServerError, fmt.Sprintf("Failed to create virtual network: %v", err))
+					return
+				}
+				r.JSON(http.StatusOK, vnet)
+			})
+
+			f.Delete("/vnets/{id}", func(c flamego.Context, r flamego.Render, principle *database.Principal) {
+				id, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+				err := db.DeleteVirtualNetworkByID(c.Request().Context(), id, principle.ID)
+				if err != nil {
+					r.PlainText(http.StatusInternalServerError, fmt.Sprintf("Failed to delete virtual network: %v", err))
+					return
+				}
+				r.PlainText(http.StatusOK, "OK")
+			})
+
+			// Used by the pgrok client's vnet SOCKS5 listener to build its
+			// local routing table: it uses the principal's first default
+			// vnet, created lazily on first use.
+			f.Get("/vnets/default/routes", func(c flamego.Context, r flamego.Render, principle *database.Principal) {
+				vnet, err := db.GetOrCreateDefaultVirtualNetwork(c.Request().Context(), principle.ID)
+				if err != nil {
+					r.PlainText(http.StatusInternalServerError, fmt.Sprintf("Failed to get default virtual network: %v", err))
+					return
+				}
+
+				routes, err := db.GetIPRoutesByVNetID(c.Request().Context(), vnet.ID)
+				if err != nil {
+					r.PlainText(http.StatusInternalServerError, fmt.Sprintf("Failed to get IP routes: %v", err))
+					return
+				}
+				r.JSON(http.StatusOK, routes)
+			})
+
+			// Used by `pgrok vnet route add`, which identifies the tunnel by
+			// name and doesn't need to know the vnet's ID: it uses the
+			// principal's first default vnet, created lazily on first use.
+			f.Post("/vnets/default/routes", func(c flamego.Context, r flamego.Render, principle *database.Principal) {
+				var form struct {
+					Network    string `json:"network"`
+					TunnelName string `json:"tunnelName"`
+					Comment    string `json:"comment"`
+				}
+				if err := json.NewDecoder(c.Request().Request.Body).Decode(&form); err != nil {
+					r.PlainText(http.StatusBadRequest, "Invalid request body")
+					return
+				}
+				if _, err := netip.ParsePrefix(form.Network); err != nil {
+					r.PlainText(http.StatusBadRequest, fmt.Sprintf("Invalid CIDR %q: %v", form.Network, err))
+					return
+				}
+
+				tunnel, err := db.GetTunnelByPrincipalIDAndName(c.Request().Context(), principle.ID, form.TunnelName)
+				if err != nil {
+					r.PlainText(http.StatusNotFound, fmt.Sprintf("Tunnel %q not found", form.TunnelName))
+					return
+				}
+
+				vnet, err := db.GetOrCreateDefaultVirtualNetwork(c.Request().Context(), principle.ID)
+				if err != nil {
+					r.PlainText(http.StatusInternalServerError, fmt.Sprintf("Failed to get default virtual network: %v", err))
+					return
+				}
+
+				route, err := db.CreateIPRoute(c.Request().Context(), database.CreateIPRouteOptions{
+					VNetID:   vnet.ID,
+					Network:  form.Network,
+					TunnelID: tunnel.ID,
+					Comment:  form.Comment,
+				})
+				if err != nil {
+					r.PlainText(http.StatusInternalServerError, fmt.Sprintf("Failed to create IP route: %v", err))
+					return
+				}
+				if err := db.AddVNetMember(c.Request().Context(), vnet.ID, tunnel.ID); err != nil {
+					r.PlainText(http.StatusInternalServerError, fmt.Sprintf("Failed to add vnet member: %v", err))
+					return
+				}
+				r.JSON(http.StatusOK, route)
+			})
+
+			f.Get("/vnets/{id}/routes", func(c flamego.Context, r flamego.Render, principle *database.Principal) {
+				id, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+				vnet, err := db.GetVirtualNetworkByID(c.Request().Context(), id, principle.ID)
+				if err != nil {
+					r.PlainText(http.StatusNotFound, "Virtual network not found")
+					return
+				}
+
+				routes, err := db.GetIPRoutesByVNetID(c.Request().Context(), vnet.ID)
+				if err != nil {
+					r.PlainText(http.StatusInternalServerError, fmt.Sprintf("Failed to get IP routes: %v", err))
+					return
+				}
+				r.JSON(http.StatusOK, routes)
+			})
+
+			f.Post("/vnets/{id}/routes", func(c flamego.Context, r flamego.Render, principle *database.Principal) {
+				id, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+				vnet, err := db.GetVirtualNetworkByID(c.Request().Context(), id, principle.ID)
+				if err != nil {
+					r.PlainText(http.StatusNotFound, "Virtual network not found")
+					return
+				}
+
+				var form struct {
+					Network  string `json:"network"`
+					TunnelID int64  `json:"tunnelId"`
+					Comment  string `json:"comment"`
+				}
+				if err := json.NewDecoder(c.Request().Request.Body).Decode(&form); err != nil {
+					r.PlainText(http.StatusBadRequest, "Invalid request body")
+					return
+				}
+				if _, err := netip.ParsePrefix(form.Network); err != nil {
+					r.PlainText(http.StatusBadRequest, fmt.Sprintf("Invalid CIDR %q: %v", form.Network, err))
+					return
+				}
+
+				tunnel, err := db.GetTunnelByID(c.Request().Context(), form.TunnelID)
+				if err != nil || tunnel.PrincipalID != principle.ID {
+					r.PlainText(http.StatusBadRequest, "Tunnel not found")
+					return
+				}
+
+				route, err := db.CreateIPRoute(c.Request().Context(), database.CreateIPRouteOptions{
+					VNetID:   vnet.ID,
+					Network:  form.Network,
+					TunnelID: form.TunnelID,
+					Comment:  form.Comment,
+				})
+				if err != nil {
+					r.PlainText(http.StatusInternalServerError, fmt.Sprintf("Failed to create IP route: %v", err))
+					return
+				}
+				if err := db.AddVNetMember(c.Request().Context(), vnet.ID, form.TunnelID); err != nil {
+					r.PlainText(http.StatusInternalServerError, fmt.Sprintf("Failed to add vnet member: %v", err))
+					return
+				}
+				r.JSON(http.StatusOK, route)
+			})
+
+			f.Delete("/vnets/{id}/routes/{routeID}", func(c flamego.Context, r flamego.Render, principle *database.Principal) {
+				id, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+				routeID, _ := strconv.ParseInt(c.Param("routeID"), 10, 64)
+
+				vnet, err := db.GetVirtualNetworkByID(c.Request().Context(), id, principle.ID)
+				if err != nil {
+					r.PlainText(http.StatusNotFound, "Virtual network not found")
+					return
+				}
+
+				if err := db.DeleteIPRouteByID(c.Request().Context(), routeID, vnet.ID); err != nil {
+					r.PlainText(http.StatusInternalServerError, fmt.Sprintf("Failed to delete IP route: %v", err))
+					return
+				}
+				r.PlainText(http.StatusOK, "OK")
+			})
 		},
 		func(c flamego.Context, r flamego.Render, s session.Session) {
+			// The pgrok CLI doesn't hold a browser session, so it instead
+			// authenticates with the per-device access token obtained via
+			// `pgrok login` (see registerOAuthRoutes).
+			if token, ok := bearerToken(c.Request().Request); ok {
+				tunnelToken, err := db.GetTunnelTokenByHash(c.Request().Context(), hashAccessToken(token))
+				if err == nil {
+					tunnel, err := db.GetTunnelByID(c.Request().Context(), tunnelToken.TunnelID)
+					if err != nil {
+						r.PlainText(http.StatusInternalServerError, fmt.Sprintf("Failed to get tunnel: %v", err))
+						return
+					}
+					principle, err := db.GetPrincipalByID(c.Request().Context(), tunnel.PrincipalID)
+					if err != nil {
+						r.PlainText(http.StatusInternalServerError, fmt.Sprintf("Failed to get principle: %v", err))
+						return
+					}
+
+					if err := db.TouchTunnelTokenLastUsed(c.Request().Context(), tunnelToken.ID); err != nil {
+						log.Error("Failed to touch tunnel token last used", "tunnelTokenId", tunnelToken.ID, "error", err)
+					}
+
+					c.Map(principle)
+					return
+				}
+			}
+
 			userID, ok := s.Get("userID").(int64)
 			if !ok || userID <= 0 {
 				c.ResponseWriter().WriteHeader(http.StatusUnauthorized)
@@ -255,123 +571,274 @@ func startWebServer(config *conf.Config, db *database.DB) {
 		},
 	)
 
-	f.Get("/api/identity-provider", func(r flamego.Render) {
-		if config.IdentityProvider == nil {
-			r.JSON(http.StatusInternalServerError, map[string]string{
-				"error": "No identity provider is configured, please ask your admin to configure an identity provider.",
-			})
+	idps, err := setupIdentityProviders(context.Background(), config)
+	if err != nil {
+		log.Fatal("Failed to set up identity providers", "error", err.Error())
+		return
+	}
+
+	var acmeManager *acme.Manager
+	if config.ACME != nil {
+		acmeManager = acme.NewManager(config.ACME, db, config.Proxy.Domain)
+		if err := acmeManager.Start(context.Background()); err != nil {
+			log.Fatal("Failed to start ACME manager", "error", err.Error())
 			return
 		}
-		r.JSON(http.StatusOK, map[string]string{
-			"displayName": config.IdentityProvider.DisplayName,
-			"authURL":     "/-/oidc/auth",
-		})
-	})
+		// The tunnel proxy's TLS listener (outside the web server) is
+		// configured with &tls.Config{GetCertificate: acmeManager.GetCertificate}
+		// so it always serves the latest certificate, hot-reloaded on renewal.
+	}
 
-	f.Group("/-", func() {
-		f.Get("/healthcheck", func(w http.ResponseWriter) {
-			w.WriteHeader(http.StatusOK)
-			_, _ = w.Write([]byte(http.StatusText(http.StatusOK)))
-		})
+	// policyAuthSecret signs the short-lived token that hands a completed
+	// tunnel-policy login off from the dashboard host (where OIDC callbacks
+	// land) to the tunnel's own subdomain (where ProxyServer sets the
+	// cookie it actually checks on every request). See /-/policy/login
+	// below and ProxyServer.servePolicyCallback. It's persisted rather than
+	// generated per process so a cookie minted by one replica still
+	// verifies on another, and survives a restart.
+	policyAuthSecret, err := db.GetOrCreateSecret(context.Background(), "policy_auth", func() ([]byte, error) {
+		return []byte(strutil.MustRandomChars(32)), nil
+	})
+	if err != nil {
+		log.Fatal("Failed to load policy auth secret", "error", err.Error())
+		return
+	}
 
-		f.Get("/oidc/auth", func(c flamego.Context, r flamego.Render, s session.Session) {
-			if config.IdentityProvider == nil {
-				r.PlainText(http.StatusBadRequest, "Sorry but ask your admin to configure an identity provider first")
-				return
+	if config.Proxy.Port != 0 {
+		proxyServer := NewProxyServer(config, db, policyCache, policyAuthSecret)
+		go func() {
+			if err := proxyServer.Start(acmeManager); err != nil {
+				log.Fatal("Failed to start tunnel proxy", "error", err.Error())
 			}
+		}()
+	}
 
-			p, err := oidc.NewProvider(c.Request().Context(), config.IdentityProvider.Issuer)
-			if err != nil {
-				r.PlainText(http.StatusInternalServerError, fmt.Sprintf("Failed to create new provider: %v", err))
-				return
+	if config.SSH.Port != 0 {
+		sshServer, err := NewSSHServer(config, db, policyCache)
+		if err != nil {
+			log.Fatal("Failed to create SSH server", "error", err.Error())
+			return
+		}
+		go func() {
+			if err := sshServer.Start(); err != nil {
+				log.Fatal("Failed to start SSH server", "error", err.Error())
 			}
+		}()
+	}
 
-			nonce := strutil.MustRandomChars(10)
-			s.Set("oidc::nonce", nonce)
+	f.Get("/api/identity-providers", func(r flamego.Render) {
+		resp := make([]map[string]string, 0, len(idps))
+		for _, idp := range idps {
+			resp = append(resp, map[string]string{
+				"id":          idp.conf.ID,
+				"displayName": idp.conf.DisplayName,
+				"authURL":     "/-/oidc/" + idp.conf.ID + "/auth",
+			})
+		}
+		r.JSON(http.StatusOK, resp)
+	})
 
-			c.Redirect(
-				fmt.Sprintf(p.Endpoint().AuthURL+"?client_id=%s&redirect_uri=%s&state=%s&nonce=%s&response_type=code&scope=%s&hd=%s",
-					config.IdentityProvider.ClientID,
-					config.ExternalURL+"/-/oidc/callback",
-					nonce,
-					nonce,
-					url.QueryEscape("openid profile email"),
-					config.IdentityProvider.RequiredDomain,
-				),
-			)
-		})
-		f.Get("/oidc/callback", func(c flamego.Context, r flamego.Render, s session.Session) {
-			if config.IdentityProvider == nil {
-				r.PlainText(http.StatusBadRequest, "Sorry but ask your admin to configure an identity provider first")
+	f.Group("/-", func() {
+		registerOAuthRoutes(f, db, idps)
+
+		f.Get("/healthcheck", func(w http.ResponseWriter, r flamego.Render) {
+			if acmeManager == nil {
+				w.WriteHeader(http.StatusOK)
+				_, _ = w.Write([]byte(http.StatusText(http.StatusOK)))
 				return
 			}
 
-			defer func() {
-				s.Delete("oidc::nonce")
-			}()
+			notAfter, ok := acmeManager.ExpiresAt()
+			r.JSON(http.StatusOK, map[string]any{
+				"status":              http.StatusText(http.StatusOK),
+				"certificateExpiry":   notAfter,
+				"certificateObtained": ok,
+			})
+		})
 
-			nonce, _ := s.Get("oidc::nonce").(string)
-			if got := c.Query("state"); nonce != got {
-				r.PlainText(http.StatusBadRequest, fmt.Sprintf("mismatched state, want %q but got %q", nonce, got))
+		// policy/login is the handoff a RequireAuth tunnel policy redirects
+		// an unauthenticated visitor to (see ProxyServer.redirectToLogin):
+		// it stashes which subdomain and URL to return to in the session
+		// and then funnels the visitor through the normal OIDC auth flow
+		// below, just like signing into the dashboard itself would.
+		f.Get("/policy/login", func(c flamego.Context, r flamego.Render, s session.Session) {
+			subdomain := c.Query("subdomain")
+			returnTo := c.Query("return")
+			if subdomain == "" || returnTo == "" {
+				r.PlainText(http.StatusBadRequest, "Missing subdomain or return")
 				return
 			}
-
-			userInfo, err := handleOIDCCallback(
-				c.Request().Context(),
-				config.IdentityProvider,
-				config.ExternalURL+"/-/oidc/callback",
-				c.Query("code"),
-				nonce,
-			)
-			if err != nil {
-				r.PlainText(http.StatusInternalServerError, fmt.Sprintf("Failed to handle callback: %v", err))
+			if got, ok := subdomainFromHost(hostOf(returnTo), config.Proxy.Domain); !ok || got != subdomain {
+				r.PlainText(http.StatusBadRequest, "Invalid return URL")
 				return
 			}
 
-			principle, err := db.UpsertPrincipal(
-				c.Request().Context(),
-				database.UpsertPrincipalOptions{
-					Identifier:  userInfo.Identifier,
-					DisplayName: userInfo.DisplayName,
-				},
-			)
-			if err != nil {
-				r.PlainText(http.StatusInternalServerError, fmt.Sprintf("Failed to upsert principle: %v", err))
+			idp := policyLoginIdentityProvider(idps)
+			if idp == nil {
+				r.PlainText(http.StatusServiceUnavailable, "No identity provider is configured")
 				return
 			}
 
-			// Create a default tunnel if none exists
-			tunnels, err := db.GetTunnelsByPrincipalID(c.Request().Context(), principle.ID)
-			if err != nil {
-				r.PlainText(http.StatusInternalServerError, fmt.Sprintf("Failed to get tunnels: %v", err))
-				return
-			}
+			s.Set("policy::subdomain", subdomain)
+			s.Set("policy::return", returnTo)
+
+			nonce := strutil.MustRandomChars(10)
+			s.Set("oidc::nonce", nonce)
+			c.Redirect(oidcAuthURL(idp, nonce))
+		})
+
+		// Routes are generated per configured identity provider at startup,
+		// rather than resolving the provider from the URL on every request.
+		for _, idp := range idps {
+			idp := idp
+
+			f.Get(fmt.Sprintf("/oidc/%s/auth", idp.conf.ID), func(c flamego.Context, r flamego.Render, s session.Session) {
+				nonce := strutil.MustRandomChars(10)
+				s.Set("oidc::nonce", nonce)
+				c.Redirect(oidcAuthURL(idp, nonce))
+			})
+
+			f.Get(fmt.Sprintf("/oidc/%s/callback", idp.conf.ID), func(c flamego.Context, r flamego.Render, s session.Session) {
+				defer func() {
+					s.Delete("oidc::nonce")
+				}()
+
+				nonce, _ := s.Get("oidc::nonce").(string)
+				if got := c.Query("state"); nonce != got {
+					r.PlainText(http.StatusBadRequest, fmt.Sprintf("mismatched state, want %q but got %q", nonce, got))
+					return
+				}
 
-			if len(tunnels) == 0 {
-				subdomain, err := userutil.NormalizeIdentifier(userInfo.Identifier)
+				userInfo, err := handleOIDCCallback(c.Request().Context(), idp, c.Query("code"), nonce)
 				if err != nil {
-					r.PlainText(http.StatusBadRequest, fmt.Sprintf("Failed to normalize identifier: %v", err))
+					r.PlainText(http.StatusInternalServerError, fmt.Sprintf("Failed to handle callback: %v", err))
 					return
 				}
 
-				_, err = db.CreateTunnel(c.Request().Context(), database.CreateTunnelOptions{
-					PrincipalID: principle.ID,
-					Name:        "Default",
-					Token:       cryptoutil.SHA1(strutil.MustRandomChars(10)),
-					Subdomain:   subdomain,
-				})
+				// A /-/policy/login redirect here means the visitor is
+				// completing a tunnel's RequireAuth policy, not signing
+				// into the dashboard: there's no principal to upsert, just
+				// a signed cookie to mint and hand off to the ProxyServer
+				// running on the tunnel's own subdomain.
+				if subdomain, ok := s.Get("policy::subdomain").(string); ok && subdomain != "" {
+					returnTo, _ := s.Get("policy::return").(string)
+					s.Delete("policy::subdomain")
+					s.Delete("policy::return")
+
+					claims := policy.Claims{
+						Email:        userInfo.Email,
+						Groups:       userInfo.Groups,
+						HostedDomain: userInfo.HostedDomain,
+					}
+					token, err := policy.SignSubdomainCookie(policyAuthSecret, subdomain, claims, policyCookieTTL)
+					if err != nil {
+						r.PlainText(http.StatusInternalServerError, fmt.Sprintf("Failed to sign policy cookie: %v", err))
+						return
+					}
+
+					callbackURL := fmt.Sprintf("%s://%s.%s/-/policy/callback?token=%s&return=%s",
+						config.Proxy.Scheme,
+						subdomain,
+						config.Proxy.Domain,
+						url.QueryEscape(token),
+						url.QueryEscape(returnTo),
+					)
+					c.Redirect(callbackURL)
+					return
+				}
+
+				// Remember the raw ID Token and which provider issued it, so
+				// sign-out can hand it back to the right IdP as the
+				// id_token_hint for RP-initiated logout.
+				s.Set("oidc::id_token_hint", userInfo.RawIDToken)
+				s.Set("oidc::provider_id", idp.conf.ID)
+
+				principle, err := db.UpsertPrincipal(
+					c.Request().Context(),
+					database.UpsertPrincipalOptions{
+						Provider:    idp.conf.ID,
+						Identifier:  userInfo.Identifier,
+						DisplayName: userInfo.DisplayName,
+					},
+				)
 				if err != nil {
-					r.PlainText(http.StatusInternalServerError, fmt.Sprintf("Failed to create default tunnel: %v", err))
+					r.PlainText(http.StatusInternalServerError, fmt.Sprintf("Failed to upsert principle: %v", err))
 					return
 				}
+
+				// Create a default tunnel if none exists
+				tunnels, err := db.GetTunnelsByPrincipalID(c.Request().Context(), principle.ID)
+				if err != nil {
+					r.PlainText(http.StatusInternalServerError, fmt.Sprintf("Failed to get tunnels: %v", err))
+					return
+				}
+
+				if len(tunnels) == 0 {
+					subdomain, err := userutil.NormalizeIdentifier(userInfo.Identifier)
+					if err != nil {
+						r.PlainText(http.StatusBadRequest, fmt.Sprintf("Failed to normalize identifier: %v", err))
+						return
+					}
+
+					_, err = db.CreateTunnel(c.Request().Context(), database.CreateTunnelOptions{
+						PrincipalID: principle.ID,
+						Name:        "Default",
+						Token:       cryptoutil.SHA1(strutil.MustRandomChars(10)),
+						Subdomain:   subdomain,
+					})
+					if err != nil {
+						r.PlainText(http.StatusInternalServerError, fmt.Sprintf("Failed to create default tunnel: %v", err))
+						return
+					}
+				}
+
+				s.Set("userID", principle.ID)
+
+				// A /-/authorize redirect here means a `pgrok login` was
+				// waiting on this sign-in to resume the CLI's OAuth flow;
+				// send the browser back to finish it instead of the
+				// dashboard home.
+				if returnTo, ok := s.Get("authorize::return").(string); ok && returnTo != "" {
+					s.Delete("authorize::return")
+					c.Redirect(returnTo)
+					return
+				}
+
+				c.Redirect("/")
+			})
+		}
+
+		f.Get("/sign-out", func(c flamego.Context, s session.Session) {
+			idTokenHint, _ := s.Get("oidc::id_token_hint").(string)
+			providerID, _ := s.Get("oidc::provider_id").(string)
+
+			s.Delete("userID")
+			s.Delete("oidc::id_token_hint")
+			s.Delete("oidc::provider_id")
+
+			idp := idps[providerID]
+			if idp == nil || idp.conf.EndSessionEndpoint == "" {
+				c.Redirect("/")
+				return
 			}
 
-			s.Set("userID", principle.ID)
-			c.Redirect("/")
+			postLogoutRedirectURI := config.ExternalURL + "/-/oidc/logout-callback"
+			if len(idp.conf.PostLogoutRedirectURIs) > 0 {
+				postLogoutRedirectURI = idp.conf.PostLogoutRedirectURIs[0]
+			}
+			c.Redirect(
+				fmt.Sprintf(idp.conf.EndSessionEndpoint+"?client_id=%s&id_token_hint=%s&post_logout_redirect_uri=%s",
+					url.QueryEscape(idp.conf.ClientID),
+					url.QueryEscape(idTokenHint),
+					url.QueryEscape(postLogoutRedirectURI),
+				),
+			)
 		})
 
-		f.Get("/sign-out", func(c flamego.Context, s session.Session) {
+		f.Get("/oidc/logout-callback", func(c flamego.Context, s session.Session) {
 			s.Delete("userID")
+			s.Delete("oidc::id_token_hint")
+			s.Delete("oidc::provider_id")
 			c.Redirect("/")
 		})
 	})
@@ -381,7 +848,7 @@ func startWebServer(config *conf.Config, db *database.DB) {
 		"address", address,
 		"env", flamego.Env(),
 	)
-	err := http.ListenAndServe(address, f)
+	err = http.ListenAndServe(address, f)
 	if err != nil {
 		log.Fatal("Failed to start web server", "error", err)
 	}
@@ -390,25 +857,114 @@ func startWebServer(config *conf.Config, db *database.DB) {
 type idpUserInfo struct {
 	Identifier  string
 	DisplayName string
+
+	// Email, Groups, and HostedDomain are read from the "email", "groups",
+	// and "hd" claims (independent of FieldMapping, which only covers the
+	// fields used to identify and display the principal) so a tunnel's
+	// TunnelPolicy can check them via policy.Claims.
+	Email        string
+	Groups       []string
+	HostedDomain string
+
+	// RawIDToken is the raw, unparsed ID Token returned by the token
+	// endpoint, kept around so it can be replayed to the IdP as the
+	// id_token_hint during RP-initiated logout.
+	RawIDToken string
 }
 
-func handleOIDCCallback(ctx context.Context, idp *conf.IdentityProvider, redirectURL, code, nonce string) (*idpUserInfo, error) {
-	p, err := oidc.NewProvider(ctx, idp.Issuer)
-	if err != nil {
-		return nil, errors.Wrap(err, "create new provider")
+// discoverEndSessionEndpoint caches idp.EndSessionEndpoint from the
+// provider's discovery document, if not already cached. The OIDC RP-Initiated
+// Logout 1.0 endpoint isn't part of the core oidc.Provider fields, so it's
+// read out of the raw discovery claims instead. Providers that don't
+// advertise one are left with an empty EndSessionEndpoint, and sign-out falls
+// back to only clearing the local session.
+func discoverEndSessionEndpoint(ctx context.Context, p *oidc.Provider, idp *conf.IdentityProvider) {
+	if idp.EndSessionEndpoint != "" {
+		return
 	}
 
-	oauth2Config := oauth2.Config{
-		ClientID:     idp.ClientID,
-		ClientSecret: idp.ClientSecret,
-		RedirectURL:  redirectURL,
+	var claims struct {
+		EndSessionEndpoint string `json:"end_session_endpoint"`
+	}
+	if err := p.Claims(&claims); err != nil {
+		log.Error("Failed to read end_session_endpoint from provider discovery document", "error", err)
+		return
+	}
+	idp.EndSessionEndpoint = claims.EndSessionEndpoint
+}
+
+// idpRuntime holds the state for a configured identity provider that's
+// expensive to (re)build on every request: the discovered oidc.Provider and
+// the oauth2.Config derived from it. It's constructed once at startup by
+// setupIdentityProviders and reused across all auth/callback requests.
+type idpRuntime struct {
+	conf        *conf.IdentityProvider
+	provider    *oidc.Provider
+	oauth2      oauth2.Config
+	redirectURL string
+}
+
+// setupIdentityProviders discovers and caches an idpRuntime for every
+// identity provider in config.IdentityProviders, keyed by provider ID.
+func setupIdentityProviders(ctx context.Context, config *conf.Config) (map[string]*idpRuntime, error) {
+	idps := make(map[string]*idpRuntime, len(config.IdentityProviders))
+	for _, idpConf := range config.IdentityProviders {
+		p, err := oidc.NewProvider(ctx, idpConf.Issuer)
+		if err != nil {
+			return nil, errors.Wrapf(err, "create new provider for %q", idpConf.ID)
+		}
+
+		discoverEndSessionEndpoint(ctx, p, idpConf)
 
-		// Discovery returns the OAuth2 endpoints.
-		Endpoint: p.Endpoint(),
-		Scopes:   []string{oidc.ScopeOpenID, "profile", "email"},
+		redirectURL := config.ExternalURL + "/-/oidc/" + idpConf.ID + "/callback"
+		idps[idpConf.ID] = &idpRuntime{
+			conf:     idpConf,
+			provider: p,
+			oauth2: oauth2.Config{
+				ClientID:     idpConf.ClientID,
+				ClientSecret: idpConf.ClientSecret,
+				RedirectURL:  redirectURL,
+
+				// Discovery returns the OAuth2 endpoints.
+				Endpoint: p.Endpoint(),
+				Scopes:   []string{oidc.ScopeOpenID, "profile", "email"},
+			},
+			redirectURL: redirectURL,
+		}
+	}
+	return idps, nil
+}
+
+// oidcAuthURL builds the redirect to idp's authorization endpoint, tagging
+// the round trip with nonce as both the OAuth2 state and the OIDC nonce.
+func oidcAuthURL(idp *idpRuntime, nonce string) string {
+	return fmt.Sprintf(idp.provider.Endpoint().AuthURL+"?client_id=%s&redirect_uri=%s&state=%s&nonce=%s&response_type=code&scope=%s&hd=%s",
+		idp.conf.ClientID,
+		idp.redirectURL,
+		nonce,
+		nonce,
+		url.QueryEscape("openid profile email"),
+		idp.conf.RequiredDomain,
+	)
+}
+
+// policyLoginIdentityProvider picks which identity provider /-/policy/login
+// sends a tunnel visitor to. A tunnel's RequireAuth policy doesn't name one
+// explicitly, so this deterministically picks the lowest ID; instances that
+// federate with more than one IdP and want a different one gating tunnel
+// access should give it the lexicographically first ID.
+func policyLoginIdentityProvider(idps map[string]*idpRuntime) *idpRuntime {
+	var firstID string
+	for id := range idps {
+		if firstID == "" || id < firstID {
+			firstID = id
+		}
 	}
+	return idps[firstID]
+}
 
-	token, err := oauth2Config.Exchange(ctx, code)
+func handleOIDCCallback(ctx context.Context, idp *idpRuntime, code, nonce string) (*idpUserInfo, error) {
+	token, err := idp.oauth2.Exchange(ctx, code)
 	if err != nil {
 		return nil, errors.Wrap(err, "exchange token")
 	}
@@ -419,7 +975,7 @@ func handleOIDCCallback(ctx context.Context, idp *conf.IdentityProvider, redirec
 		return nil, errors.New(`missing "id_token" from the issuer's authorization response`)
 	}
 
-	verifier := p.Verifier(&oidc.Config{ClientID: oauth2Config.ClientID})
+	verifier := idp.provider.Verifier(&oidc.Config{ClientID: idp.oauth2.ClientID})
 	idToken, err := verifier.Verify(ctx, rawIDToken)
 	if err != nil {
 		return nil, errors.Wrap(err, "verify raw ID Token")
@@ -428,7 +984,7 @@ func handleOIDCCallback(ctx context.Context, idp *conf.IdentityProvider, redirec
 		return nil, errors.Errorf("mismatched nonce, want %q but got %q", nonce, idToken.Nonce)
 	}
 
-	rawUserInfo, err := p.UserInfo(ctx, oauth2.StaticTokenSource(token))
+	rawUserInfo, err := idp.provider.UserInfo(ctx, oauth2.StaticTokenSource(token))
 	if err != nil {
 		return nil, errors.Wrap(err, "fetch user info")
 	}
@@ -440,17 +996,17 @@ func handleOIDCCallback(ctx context.Context, idp *conf.IdentityProvider, redirec
 	}
 	log.Debug("User info", "claims", claims)
 
-	userInfo := &idpUserInfo{}
-	if v, ok := claims[idp.FieldMapping.Identifier].(string); ok {
+	userInfo := &idpUserInfo{RawIDToken: rawIDToken}
+	if v, ok := claims[idp.conf.FieldMapping.Identifier].(string); ok {
 		userInfo.Identifier = v
 	}
 	if userInfo.Identifier == "" {
-		return nil, errors.Errorf("the field %q is not found in claims or has empty value", idp.FieldMapping.Identifier)
+		return nil, errors.Errorf("the field %q is not found in claims or has empty value", idp.conf.FieldMapping.Identifier)
 	}
 
 	// Best effort to map optional fields
-	if idp.FieldMapping.DisplayName != "" {
-		if v, ok := claims[idp.FieldMapping.DisplayName].(string); ok {
+	if idp.conf.FieldMapping.DisplayName != "" {
+		if v, ok := claims[idp.conf.FieldMapping.DisplayName].(string); ok {
 			userInfo.DisplayName = v
 		}
 	}
@@ -458,11 +1014,33 @@ func handleOIDCCallback(ctx context.Context, idp *conf.IdentityProvider, redirec
 		userInfo.DisplayName = userInfo.Identifier
 	}
 
-	if idp.RequiredDomain != "" {
-		email, _ := claims[idp.FieldMapping.Email].(string)
-		if !strings.HasSuffix(email, "@"+idp.RequiredDomain) {
-			return nil, errors.Errorf("the email %q does not have required domain %q", email, idp.RequiredDomain)
+	if idp.conf.RequiredDomain != "" {
+		email, _ := claims[idp.conf.FieldMapping.Email].(string)
+		if !strings.HasSuffix(email, "@"+idp.conf.RequiredDomain) {
+			return nil, errors.Errorf("the email %q does not have required domain %q", email, idp.conf.RequiredDomain)
+		}
+	}
+
+	userInfo.Email, _ = claims["email"].(string)
+	userInfo.HostedDomain, _ = claims["hd"].(string)
+	if rawGroups, ok := claims["groups"].([]any); ok {
+		for _, g := range rawGroups {
+			if s, ok := g.(string); ok {
+				userInfo.Groups = append(userInfo.Groups, s)
+			}
 		}
 	}
 	return userInfo, nil
 }
+
+// bearerToken extracts the token from an "Authorization: Bearer <token>"
+// header, as sent by the pgrok CLI when calling the API with a per-device
+// access token.
+func bearerToken(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	token, ok := strings.CutPrefix(auth, "Bearer ")
+	if !ok || token == "" {
+		return "", false
+	}
+	return token, true
+}